@@ -1,21 +1,35 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"hash/fnv"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"net/http/httptrace"
 	"net/url"
 	"os"
+	"os/signal"
+	"regexp"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
+	"github.com/golang/protobuf/proto"
 	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
 	"github.com/prometheus/common/log"
 	"github.com/prometheus/common/version"
 )
@@ -25,10 +39,32 @@ const (
 )
 
 var (
-	serverLabelNames = []string{"status"}
+	// defaultScrapeDurationBuckets suit management endpoints answering
+	// within a second.
+	defaultScrapeDurationBuckets = []float64{.01, .025, .05, .1, .25, .5, 1, 2.5, 5}
+
+	serverLabelNames     = []string{"status"}
+	labelNameRE          = regexp.MustCompile("^[a-zA-Z_][a-zA-Z0-9_]*$")
+	transitionLabelNames = []string{"from", "to"}
+	memberRoleLabelNames = []string{"node", "role"}
+	addressLabelNames    = []string{"node", "address", "role"}
+	nodeLabelNames       = []string{"node"}
+	systemLabelNames     = []string{"system"}
+	hostLabelNames       = []string{"host"}
+	fieldLabelNames      = []string{"field"}
+	roleLabelNames       = []string{"role"}
+
+	// responseFields are the fields of a membership response whose presence
+	// is exported, to notice schema changes before the metrics derived from
+	// them silently drop to zero.
+	responseFields = []string{"members", "leader", "oldest", "unreachable"}
+
+	// nodeLabelReplacer replaces the separators of akka node addresses, which
+	// are awkward in dashboards and some downstream systems.
+	nodeLabelReplacer = strings.NewReplacer("://", "_", "@", "_", ":", "_")
 )
 
-func newServerMetric(metricName string, docString string, constLabels prometheus.Labels) *prometheus.GaugeVec {
+func newServerMetric(metricName string, docString string, constLabels prometheus.Labels, labelNames []string) *prometheus.GaugeVec {
 	return prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
 			Namespace:   namespace,
@@ -36,7 +72,7 @@ func newServerMetric(metricName string, docString string, constLabels prometheus
 			Help:        docString,
 			ConstLabels: constLabels,
 		},
-		serverLabelNames,
+		labelNames,
 	)
 }
 
@@ -56,52 +92,525 @@ func (m metrics) String() string {
 }
 
 var (
-	serverMetrics = metrics{
-		2: newServerMetric("current_members", "Current number of members of the akka cluster.", nil),
+	// memberStatuses lists the member states exported as status label values.
+	memberStatuses = []string{"Up", "Down", "Joining", "WeaklyUp", "Leaving", "Exiting", "Removed"}
+
+	// canonicalStatuses maps member states, lower cased and stripped of
+	// separators, to the spelling used by Akka.
+	canonicalStatuses = map[string]string{
+		"joining":  "Joining",
+		"weaklyup": "WeaklyUp",
+		"up":       "Up",
+		"leaving":  "Leaving",
+		"exiting":  "Exiting",
+		"down":     "Down",
+		"removed":  "Removed",
 	}
 )
 
+// newServerMetrics returns the per-status member metrics. Every Exporter has
+// its own, so several can be registered side by side.
+func newServerMetrics(labelNames []string) metrics {
+	return metrics{
+		2: newServerMetric("current_members", "Current number of members of the akka cluster.", nil, labelNames),
+	}
+}
+
+func newStatusRatio(labelNames []string) *prometheus.GaugeVec {
+	return newServerMetric("members_status_ratio", "Fraction of akka cluster members in each status.", nil, labelNames)
+}
+
 type ClusterNode struct {
-	Node    string
-	NodeUid string
-	Status  string
-	Roles   []string
+	Node       string
+	NodeUid    string
+	Status     string
+	Roles      []string
+	DataCenter string
+	AppVersion string
+	ObservedBy []string
+}
+
+// dataCenter returns the data center of the given member. Older management
+// endpoints only expose it through the dc-<name> role Akka assigns to every
+// member; members without either belong to the default data center.
+func dataCenter(n ClusterNode) string {
+	if n.DataCenter != "" {
+		return n.DataCenter
+	}
+	for _, role := range n.Roles {
+		if strings.HasPrefix(role, "dc-") {
+			return strings.TrimPrefix(role, "dc-")
+		}
+	}
+	return "default"
 }
 
 type Cluster struct {
-	SelfNode    string
-	Leader      string
-	Oldest      string
-	Unreachable []ClusterNode
-	Members     []ClusterNode
+	SelfNode      string
+	Leader        string
+	Oldest        string
+	OldestPerRole map[string]string
+	Unreachable   []ClusterNode
+	Members       []ClusterNode
+}
+
+// parseCluster parses a membership response. Besides the members object
+// itself, responses wrapping it in a single object, as some management
+// routes and proxies do, are accepted.
+func parseCluster(b []byte) (Cluster, error) {
+	var m Cluster
+	raw, _, err := membersObject(b)
+	if err != nil {
+		return m, err
+	}
+	err = json.Unmarshal(raw, &m)
+	return m, err
+}
+
+// checkCluster reports fields of a membership response that don't map to
+// Cluster or ClusterNode.
+func checkCluster(b []byte) error {
+	raw, _, err := membersObject(b)
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.DisallowUnknownFields()
+	var m Cluster
+	return dec.Decode(&m)
+}
+
+// membersObject returns the members object of a membership response and its
+// fields. If there is none, or several wrapped ones, the fields of the
+// response itself are returned along with the error.
+func membersObject(b []byte) (json.RawMessage, map[string]json.RawMessage, error) {
+	b = trimJSON(b)
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(b, &fields); err != nil {
+		return nil, nil, err
+	}
+	if hasField(fields, "members") {
+		return b, fields, nil
+	}
+	var wrappers []string
+	var raw json.RawMessage
+	var nested map[string]json.RawMessage
+	for k, v := range fields {
+		var f map[string]json.RawMessage
+		if json.Unmarshal(v, &f) == nil && hasField(f, "members") {
+			wrappers = append(wrappers, k)
+			raw, nested = v, f
+		}
+	}
+	switch len(wrappers) {
+	case 0:
+		return nil, fields, fmt.Errorf("unrecognized membership response: no members field found")
+	case 1:
+		return raw, nested, nil
+	default:
+		sort.Strings(wrappers)
+		return nil, fields, fmt.Errorf("ambiguous membership response: members field found in %s", strings.Join(wrappers, ", "))
+	}
+}
+
+// trimJSON strips the UTF-8 byte order mark and whitespace some proxies put
+// around JSON documents.
+func trimJSON(b []byte) []byte {
+	return bytes.TrimSpace(bytes.TrimPrefix(bytes.TrimSpace(b), []byte("\xef\xbb\xbf")))
+}
+
+// hasField reports whether fields contains name, ignoring case like
+// json.Unmarshal does.
+func hasField(fields map[string]json.RawMessage, name string) bool {
+	for k := range fields {
+		if strings.EqualFold(k, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseNodeAddress splits an Akka node address such as
+// akka.tcp://System@host:2552 or akka://System@[::1]:2552 into its actor
+// system name, host and port. IPv6 hosts are returned without brackets.
+func parseNodeAddress(node string) (system, host, port string, err error) {
+	u, err := url.Parse(node)
+	if err != nil {
+		return "", "", "", err
+	}
+	if u.User == nil || u.Host == "" {
+		return "", "", "", fmt.Errorf("invalid akka node address: %q", node)
+	}
+	host, port, err = net.SplitHostPort(u.Host)
+	if err != nil {
+		return "", "", "", err
+	}
+	return u.User.Username(), host, port, nil
 }
 
 // Exporter collects Akka Cluster HTTP stats from the given URI and exports them using
 // the prometheus metrics package.
 type Exporter struct {
-	URI           string
-	mutex         sync.RWMutex
-	fetch         func() (io.ReadCloser, error)
-	up            prometheus.Gauge
-	serverMetrics map[int]*prometheus.GaugeVec
+	URI                 string
+	mutex               sync.RWMutex
+	fetch               func(ctx context.Context) (io.ReadCloser, error)
+	up                  prometheus.Gauge
+	scrapesSinceSuccess prometheus.Gauge
+	startTime           prometheus.Gauge
+	targets             prometheus.Gauge
+	serverMetrics       map[int]*prometheus.GaugeVec
+	statusRatio         *prometheus.GaugeVec
+	dataCenters         prometheus.Gauge
+	distinctStatuses    prometheus.Gauge
+	responseBytes       prometheus.Gauge
+
+	departing               prometheus.Gauge
+	missingUID              prometheus.Gauge
+	avgRoles                prometheus.Gauge
+	singletonRoles          prometheus.Gauge
+	unreachableObservers    prometheus.Gauge
+	selfNodePresent         prometheus.Gauge
+	unreachableNotInMembers prometheus.Gauge
+	upButUnreachable        prometheus.Gauge
+	minorityUnreachable     prometheus.Gauge
+	hasLeader               prometheus.Gauge
+	selfIsOldest            prometheus.Gauge
+	appVersionSkew          prometheus.Gauge
+
+	// ExpectedRoles are the roles the cluster should consist of. Roles
+	// missing from the members or held by members without being expected
+	// are only exported when it is set.
+	ExpectedRoles   []string
+	missingRoles    prometheus.Gauge
+	unexpectedRoles prometheus.Gauge
+
+	// ExpectedSize is the number of members the cluster should have. The
+	// difference to the actual size is only exported when it is set.
+	ExpectedSize      int
+	membersVsExpected prometheus.Gauge
+
+	// Statuses limits the status label values exported by the per-status
+	// member metrics. All known statuses are exported when it is empty.
+	Statuses []string
+
+	// RoleMetrics exports one series per member and role it holds.
+	RoleMetrics       bool
+	memberRoles       *prometheus.GaugeVec
+	sanitizeNodeLabel bool
+
+	membersBySystem *prometheus.GaugeVec
+	membersByHost   *prometheus.GaugeVec
+	fieldPresent    *prometheus.GaugeVec
+
+	unreachableByRole *prometheus.GaugeVec
+	singletonRoleInfo *prometheus.GaugeVec
+
+	// clusterGauges holds the gauges describing the last response read from
+	// the endpoint. They are only collected while haveData is set, like the
+	// vectors which are reset once the view is gone.
+	clusterGauges []prometheus.Gauge
+	haveData      bool
+
+	// nodeViewGauges are the cluster gauges derived from the self node,
+	// the oldest member, app versions or observers. The domain events
+	// stream carries none of these, so they aren't collected while
+	// fromDomainEvents is set rather than reporting misleading zeros.
+	nodeViewGauges   []prometheus.Gauge
+	fromDomainEvents bool
+
+	// lastResponse holds up to maxLastResponseBytes of the last response
+	// read from the endpoint, for debugging. Responses that can't be parsed
+	// are kept too, as they are the ones worth looking at.
+	lastResponse []byte
+
+	// state is the view parsed from the last successful scrape, served on
+	// /state.
+	state *clusterState
+
+	// consensus is set when the exporter merges the views of several nodes.
+	consensus        bool
+	viewDisagreement prometheus.Gauge
+
+	// KeepLastOnFailure keeps serving the member metrics of the last
+	// successful scrape when the endpoint can't be scraped.
+	KeepLastOnFailure bool
+
+	// CircuitBreakerThreshold is the number of consecutive failed scrapes
+	// after which the endpoint is left alone for CircuitBreakerCooldown,
+	// reporting it as down meanwhile. Zero disables the circuit breaker.
+	CircuitBreakerThreshold int
+	CircuitBreakerCooldown  time.Duration
+	consecutiveFailures     int
+	circuitOpenUntil        time.Time
+	circuitOpen             prometheus.Gauge
+
+	// SeparateScrapeStats leaves the metrics collected by ScrapeStats out of
+	// the exporter's own.
+	SeparateScrapeStats bool
+
+	// StrictJSON checks responses for fields unknown to Cluster and
+	// ClusterNode. With "log" they are logged, with "fail" the response is
+	// rejected as unparseable. Empty disables the check.
+	StrictJSON string
+
+	// FieldMapping renames fields of responses from nonstandard endpoints,
+	// e.g. self_node to selfNode, before they are parsed.
+	FieldMapping map[string]string
+
+	// JSONRoot is the dot separated path of the members object within
+	// responses wrapping it in an envelope. Responses are used as a whole
+	// when it is empty.
+	JSONRoot string
+
+	// UpRequiresParse reports the endpoint as up only once its response was
+	// parsed, instead of as soon as it answered.
+	UpRequiresParse bool
+
+	// ExcludeSelf leaves the node serving the management endpoint out of the
+	// member tallies, so they only reflect how it sees its peers.
+	ExcludeSelf bool
+
+	// DropRemoved leaves Removed members out of the view altogether, as if
+	// the endpoint hadn't reported them.
+	DropRemoved bool
+
+	// CollectTimeout bounds a whole scrape, including retries. Zero means
+	// only the per-request timeout applies.
+	CollectTimeout time.Duration
+
+	// NormalizeStatus maps differently spelled member statuses, such as
+	// "Weakly Up" or "weaklyup", to the spelling used by Akka.
+	NormalizeStatus bool
+	// statusesMutex guards unknownStatuses, as the views fetched for /diff
+	// and -check are normalized outside the mutex.
+	statusesMutex   sync.Mutex
+	unknownStatuses map[string]bool
+
+	// Retries is the number of times a failed fetch is retried within a
+	// scrape, waiting RetryInterval in between.
+	Retries       int
+	RetryInterval time.Duration
+	retries       prometheus.Counter
+
+	// ErrorLogInterval is the minimum time between logging identical scrape
+	// errors. Zero logs every error.
+	ErrorLogInterval time.Duration
+	lastError        string
+	lastErrorLogged  time.Time
+	suppressedErrors int
+
+	scrapeDuration       prometheus.Histogram
+	connsReused          prometheus.Counter
+	connectDuration      prometheus.Histogram
+	tlsHandshakeDuration prometheus.Histogram
+	connsNew             prometheus.Counter
+	certExpiry           prometheus.Gauge
+
+	// polling is set to 1 while Poll runs, Collect then serves the metrics
+	// of the latest poll instead of scraping. It is accessed atomically, as
+	// Collect reads it before waiting for the mutex.
+	polling      int32
+	pollInterval prometheus.Gauge
+	lastScrape   time.Time
+	scrapeAge    prometheus.Gauge
+
+	// scrapesInFlight counts scrapes in progress along with those queued
+	// behind them. It is updated outside the mutex.
+	scrapesInFlight prometheus.Gauge
+
+	fetchErrors prometheus.Counter
+	parseErrors prometheus.Counter
+
+	roleChanges *prometheus.CounterVec
+	lastRoles   map[string]string
+
+	// uids keeps the last UID seen for every address, including addresses
+	// gone from the members for up to uidRetention, so a node restarting
+	// under the same address is noticed even if the old incarnation was
+	// removed in between. uidsSeen holds when each address was last seen.
+	restarts *prometheus.CounterVec
+	uids     map[string]string
+	uidsSeen map[string]time.Time
+
+	stuckDown   prometheus.Gauge
+	downSeconds *prometheus.GaugeVec
+	downSince   map[string]time.Time
+
+	unreachableSeconds *prometheus.GaugeVec
+	maxUnreachable     prometheus.Gauge
+	unreachableSince   map[string]time.Time
+
+	observedLeaders prometheus.Counter
+	leaders         map[string]bool
+
+	oldestChanges     prometheus.Counter
+	sinceOldestChange prometheus.Gauge
+	lastOldest        string
+	oldestChangedAt   time.Time
+
+	// membershipHash is the hash of the members and their statuses seen on
+	// the last scrape, as computed by trackMembership.
+	membershipHash        uint64
+	membershipChangedAt   time.Time
+	sinceMembershipChange prometheus.Gauge
+
+	// TransitionsAsGauge exports member status transitions seen during the
+	// last scrape as a gauge instead of a monotonically increasing counter.
+	TransitionsAsGauge bool
+	transitions        *prometheus.CounterVec
+	transitionsGauge   *prometheus.GaugeVec
+	lastStatuses       map[string]string
 }
 
-// NewExporter returns an initialized Exporter.
-func NewExporter(uri string, timeout time.Duration) (*Exporter, error) {
+// NewExporter returns an initialized Exporter. HTTP(S) scrapes use the given
+// transport, or http.DefaultTransport if it is nil.
+func NewExporter(uri string, timeout time.Duration, transport http.RoundTripper) (*Exporter, error) {
 	u, err := url.Parse(uri)
 	if err != nil {
 		return nil, err
 	}
 
-	var fetch func() (io.ReadCloser, error)
+	e := newExporter(uri, nil)
+	fetch, err := newFetch(u, timeout, transport, e.observeTLS, e.clientTrace)
+	if err != nil {
+		return nil, err
+	}
+	e.fetch = e.unwrap(fetch)
+	return e, nil
+}
+
+// NewConsensusExporter returns an Exporter scraping every given URI, each
+// serving a different node's view of the cluster, and exporting the merge of
+// these views. Nodes that can't be scraped are left out of the merge.
+func NewConsensusExporter(uris []string, timeout time.Duration, transport http.RoundTripper) (*Exporter, error) {
+	if len(uris) == 0 {
+		return nil, fmt.Errorf("no URIs to scrape")
+	}
+	e := newExporter(uris[0], nil)
+	fetches := make([]func(ctx context.Context) (io.ReadCloser, error), len(uris))
+	for i, uri := range uris {
+		u, err := url.Parse(uri)
+		if err != nil {
+			return nil, err
+		}
+		fetch, err := newFetch(u, timeout, transport, e.observeTLS, e.clientTrace)
+		if err != nil {
+			return nil, err
+		}
+		fetches[i] = e.unwrap(fetch)
+	}
+	e.consensus = true
+	e.targets.Set(float64(len(uris)))
+	e.fetch = e.fetchConsensus(uris, fetches)
+	return e, nil
+}
+
+// unwrap returns a fetch function serving the object at JSONRoot within the
+// responses of fetch, or the whole responses if JSONRoot is empty, with
+// their fields renamed according to FieldMapping.
+func (e *Exporter) unwrap(fetch func(ctx context.Context) (io.ReadCloser, error)) func(ctx context.Context) (io.ReadCloser, error) {
+	return func(ctx context.Context) (io.ReadCloser, error) {
+		body, err := fetch(ctx)
+		if err != nil || (e.JSONRoot == "" && len(e.FieldMapping) == 0) {
+			return body, err
+		}
+		defer body.Close()
+		b, err := ioutil.ReadAll(body)
+		if err != nil {
+			return nil, err
+		}
+		if len(e.FieldMapping) > 0 {
+			if b, err = renameFields(b, e.FieldMapping); err != nil {
+				return nil, err
+			}
+		}
+		if e.JSONRoot != "" {
+			if b, err = jsonPath(b, e.JSONRoot); err != nil {
+				return nil, err
+			}
+		}
+		return ioutil.NopCloser(bytes.NewReader(b)), nil
+	}
+}
+
+// renameFields renames the fields of every object in the JSON document b
+// found in mapping.
+func renameFields(b []byte, mapping map[string]string) ([]byte, error) {
+	var v interface{}
+	dec := json.NewDecoder(bytes.NewReader(trimJSON(b)))
+	dec.UseNumber()
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	return json.Marshal(renameKeys(v, mapping))
+}
+
+func renameKeys(v interface{}, mapping map[string]string) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		renamed := make(map[string]interface{}, len(v))
+		for k, value := range v {
+			if to, ok := mapping[k]; ok {
+				k = to
+			}
+			renamed[k] = renameKeys(value, mapping)
+		}
+		return renamed
+	case []interface{}:
+		for i := range v {
+			v[i] = renameKeys(v[i], mapping)
+		}
+	}
+	return v
+}
+
+// jsonPath returns the value at the dot separated path of object keys, such
+// as data.cluster, within the JSON document b.
+func jsonPath(b []byte, path string) ([]byte, error) {
+	b = trimJSON(b)
+	for _, key := range strings.Split(path, ".") {
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(b, &fields); err != nil {
+			return nil, fmt.Errorf("can't look up %q in %q: %v", key, path, err)
+		}
+		raw, ok := fields[key]
+		if !ok {
+			return nil, fmt.Errorf("no %q field found at %q", key, path)
+		}
+		b = raw
+	}
+	return b, nil
+}
+
+func newFetch(u *url.URL, timeout time.Duration, transport http.RoundTripper, onTLS func(*tls.ConnectionState), newTrace func() *httptrace.ClientTrace) (func(ctx context.Context) (io.ReadCloser, error), error) {
 	switch u.Scheme {
 	case "http", "https":
-		fetch = fetchHTTP(uri, timeout)
+		return fetchHTTP(u.String(), timeout, transport, onTLS, newTrace), nil
+	case "file":
+		path := u.Opaque
+		if path == "" {
+			path = u.Host + u.Path
+		}
+		return fetchFile(path), nil
 	default:
 		return nil, fmt.Errorf("unsupported scheme: %q", u.Scheme)
 	}
+}
+
+// ExporterFromJSON returns an Exporter serving the metrics of the given
+// membership response on every collect. It is meant for testing alerting
+// rules and dashboards against synthetic cluster states.
+func ExporterFromJSON(b []byte) (*Exporter, error) {
+	if _, err := parseCluster(b); err != nil {
+		return nil, err
+	}
+	return newExporter("", func(ctx context.Context) (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(b)), nil
+	}), nil
+}
 
-	return &Exporter{
+func newExporter(uri string, fetch func(ctx context.Context) (io.ReadCloser, error)) *Exporter {
+	e := &Exporter{
 		URI:   uri,
 		fetch: fetch,
 		up: prometheus.NewGauge(prometheus.GaugeOpts{
@@ -109,8 +618,233 @@ func NewExporter(uri string, timeout time.Duration) (*Exporter, error) {
 			Name:      "up",
 			Help:      "Was the last scrape of akka http management endpoint successful.",
 		}),
-		serverMetrics: serverMetrics,
-	}, nil
+		scrapesSinceSuccess: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "scrapes_since_last_success",
+			Help:      "Number of failed scrapes of the akka http management endpoint since the last successful one.",
+		}),
+		startTime: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "exporter_start_time_seconds",
+			Help:      "Start time of the exporter since unix epoch in seconds.",
+		}),
+		targets: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "configured_targets",
+			Help:      "Number of akka http management endpoints the exporter scrapes.",
+		}),
+		serverMetrics: newServerMetrics(serverLabelNames),
+		statusRatio:   newStatusRatio(serverLabelNames),
+		transitions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "member_status_transitions_total",
+			Help:      "Total number of member status transitions observed between scrapes.",
+		}, transitionLabelNames),
+		transitionsGauge: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "member_status_transitions",
+			Help:      "Number of member status transitions observed since the previous scrape.",
+		}, transitionLabelNames),
+		scrapeDuration:       newScrapeDurationHistogram(defaultScrapeDurationBuckets),
+		certExpiry:           newClusterGauge("scrape_tls_cert_expiry_seconds", "Seconds until the certificate of the akka http management endpoint expires."),
+		pollInterval:         newClusterGauge("poll_interval_seconds", "Interval between background scrapes of the akka http management endpoint, 0 when scraping on every collect."),
+		scrapeAge:            newClusterGauge("scrape_age_seconds", "Seconds since the last scrape of the akka http management endpoint finished."),
+		scrapesInFlight:      newClusterGauge("scrapes_in_flight", "Number of scrapes of the akka http management endpoint in progress or waiting for the one in progress."),
+		connectDuration:      newPhaseDurationHistogram("scrape_connect_duration_seconds", "Duration of establishing TCP connections to the akka http management endpoint."),
+		tlsHandshakeDuration: newPhaseDurationHistogram("scrape_tls_handshake_duration_seconds", "Duration of TLS handshakes with the akka http management endpoint."),
+		connsReused: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "http_conn_reused_total",
+			Help:      "Total number of requests to the akka http management endpoint reusing a pooled connection.",
+		}),
+		connsNew: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "http_conn_new_total",
+			Help:      "Total number of requests to the akka http management endpoint opening a new connection.",
+		}),
+		fetchErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "scrape_fetch_errors_total",
+			Help:      "Total number of scrapes that couldn't fetch a response from the akka http management endpoint.",
+		}),
+		parseErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "scrape_parse_errors_total",
+			Help:      "Total number of akka http management responses that couldn't be parsed.",
+		}),
+		observedLeaders: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "observed_leaders_total",
+			Help:      "Number of distinct akka cluster leaders observed since the exporter started.",
+		}),
+		leaders: make(map[string]bool),
+		oldestChanges: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "oldest_changes_total",
+			Help:      "Number of times the oldest akka cluster member, hosting cluster singletons, changed between scrapes.",
+		}),
+		sinceOldestChange:     newClusterGauge("seconds_since_oldest_change", "Seconds since the oldest akka cluster member last changed, or was first seen."),
+		sinceMembershipChange: newClusterGauge("seconds_since_membership_change", "Seconds since a member joined, left or changed status in the akka cluster, or since the members were first seen."),
+		unknownStatuses:       make(map[string]bool),
+		roleChanges: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "member_role_changes_total",
+			Help:      "Total number of times an akka cluster member's roles changed between scrapes.",
+		}, nodeLabelNames),
+		restarts: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "member_restarts_total",
+			Help:      "Total number of times an akka cluster member rejoined under the same address with a new UID.",
+		}, nodeLabelNames),
+		uids:      make(map[string]string),
+		uidsSeen:  make(map[string]time.Time),
+		stuckDown: newClusterGauge("stuck_down_members", "Number of akka cluster members that stayed Down since the previous scrape."),
+		downSeconds: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "member_down_seconds",
+			Help:      "Seconds an akka cluster member has been Down without being removed.",
+		}, nodeLabelNames),
+		unreachableSeconds: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "unreachable_duration_seconds",
+			Help:      "Seconds an akka cluster node has been continuously unreachable.",
+		}, nodeLabelNames),
+		maxUnreachable: newClusterGauge("max_unreachable_duration_seconds", "Longest time any akka cluster node has been continuously unreachable, in seconds."),
+		retries: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "scrape_retries_total",
+			Help:      "Total number of retried fetches of the akka http management endpoint.",
+		}),
+		memberRoles: newMemberRoles(memberRoleLabelNames),
+		membersBySystem: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "members_by_system",
+			Help:      "Number of akka cluster members per actor system name in their address.",
+		}, systemLabelNames),
+		membersByHost: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "members_by_host",
+			Help:      "Number of akka cluster members per host in their address.",
+		}, hostLabelNames),
+		fieldPresent: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "response_field_present",
+			Help:      "Whether a field was present in the last akka http management response.",
+		}, fieldLabelNames),
+		unreachableByRole: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "unreachable_by_role",
+			Help:      "Number of unreachable akka cluster members per role, unknown for nodes missing from the members.",
+		}, roleLabelNames),
+		circuitOpen: newClusterGauge("circuit_open", "Whether scrapes of the akka http management endpoint are suspended after consecutive failures."),
+		singletonRoleInfo: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "singleton_role_info",
+			Help:      "Roles held by a single akka cluster member, always 1.",
+		}, roleLabelNames),
+		viewDisagreement:        newClusterGauge("view_disagreement", "Number of akka cluster members whose status differs between the scraped nodes' views."),
+		distinctStatuses:        newClusterGauge("distinct_statuses", "Number of distinct statuses of akka cluster members, 1 when all are alike."),
+		dataCenters:             newClusterGauge("datacenter_count", "Number of distinct data centers across akka cluster members."),
+		missingRoles:            newClusterGauge("missing_roles", "Number of expected roles not held by any akka cluster member."),
+		unexpectedRoles:         newClusterGauge("unexpected_roles", "Number of roles held by akka cluster members without being expected."),
+		membersVsExpected:       newClusterGauge("members_vs_expected", "Number of akka cluster members minus the expected number, negative when members are missing."),
+		appVersionSkew:          newClusterGauge("members_app_version_skew", "Number of akka cluster members running another app version than the scraped node."),
+		selfIsOldest:            newClusterGauge("self_is_oldest", "Whether the scraped node is the oldest akka cluster member, hosting the cluster singletons."),
+		hasLeader:               newClusterGauge("has_leader", "Whether the akka cluster has a leader."),
+		unreachableNotInMembers: newClusterGauge("unreachable_not_in_members", "Number of unreachable akka cluster nodes missing from the members."),
+		upButUnreachable:        newClusterGauge("up_but_unreachable", "Number of akka cluster members with status Up that are unreachable."),
+		minorityUnreachable:     newClusterGauge("minority_unreachable", "Number of unreachable akka cluster members observed by fewer than half of the reachable members."),
+		selfNodePresent:         newClusterGauge("self_node_present", "Whether the scraped node is part of its own list of akka cluster members."),
+		singletonRoles:          newClusterGauge("singleton_roles", "Number of roles held by a single akka cluster member."),
+		avgRoles:                newClusterGauge("avg_roles_per_member", "Average number of roles held by akka cluster members."),
+		missingUID:              newClusterGauge("members_missing_uid", "Number of akka cluster members reported without a UID."),
+		departing:               newClusterGauge("members_departing", "Number of akka cluster members leaving the cluster, i.e. Leaving or Exiting."),
+		unreachableObservers:    newClusterGauge("unreachable_observers_total", "Sum over unreachable akka cluster members of the number of members observing them as unreachable."),
+		responseBytes:           newClusterGauge("scrape_response_bytes", "Size in bytes of the last response read from the akka http management endpoint."),
+	}
+	e.startTime.Set(float64(time.Now().Unix()))
+	e.targets.Set(1)
+	e.clusterGauges = []prometheus.Gauge{
+		e.dataCenters,
+		e.distinctStatuses,
+		e.responseBytes,
+		e.stuckDown,
+		e.maxUnreachable,
+		e.departing,
+		e.missingUID,
+		e.avgRoles,
+		e.singletonRoles,
+		e.unreachableNotInMembers,
+		e.upButUnreachable,
+		e.sinceOldestChange,
+		e.sinceMembershipChange,
+		e.hasLeader,
+	}
+	e.nodeViewGauges = []prometheus.Gauge{
+		e.unreachableObservers,
+		e.selfNodePresent,
+		e.minorityUnreachable,
+		e.selfIsOldest,
+		e.appVersionSkew,
+	}
+	return e
+}
+
+func newMemberRoles(labelNames []string) *prometheus.GaugeVec {
+	return prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "member_has_role",
+		Help:      "Whether an akka cluster member holds a role, always 1.",
+	}, labelNames)
+}
+
+func newClusterGauge(metricName string, docString string) prometheus.Gauge {
+	return prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      metricName,
+		Help:      docString,
+	})
+}
+
+func newPhaseDurationHistogram(metricName string, docString string) prometheus.Histogram {
+	return prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      metricName,
+		Help:      docString,
+		Buckets:   defaultScrapeDurationBuckets,
+	})
+}
+
+func newScrapeDurationHistogram(buckets []float64) prometheus.Histogram {
+	return prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "scrape_duration_seconds",
+		Help:      "Duration of scrapes of the akka http management endpoint.",
+		Buckets:   buckets,
+	})
+}
+
+// SetStatusLabelName renames the status label of the per-status member
+// metrics, e.g. when it clashes with a target label. It must be called
+// before the exporter is registered.
+func (e *Exporter) SetStatusLabelName(name string) {
+	labelNames := []string{name}
+	e.serverMetrics = newServerMetrics(labelNames)
+	e.statusRatio = newStatusRatio(labelNames)
+}
+
+// SanitizeNodeLabel replaces the separators in the node label of
+// akka_member_has_role with underscores and keeps the raw node address in an
+// address label. It must be called before the exporter is registered.
+func (e *Exporter) SanitizeNodeLabel() {
+	e.memberRoles = newMemberRoles(addressLabelNames)
+	e.sanitizeNodeLabel = true
+}
+
+// SetScrapeDurationBuckets replaces the buckets of the scrape duration
+// histogram. It must be called before the exporter is registered.
+func (e *Exporter) SetScrapeDurationBuckets(buckets []float64) {
+	e.scrapeDuration = newScrapeDurationHistogram(buckets)
 }
 
 // Describe describes all the metrics ever exported by the Akka HTTP Management Endpoint exporter.
@@ -119,139 +853,2257 @@ func (e *Exporter) Describe(ch chan<- *prometheus.Desc) {
 	for _, m := range e.serverMetrics {
 		m.Describe(ch)
 	}
+	e.statusRatio.Describe(ch)
+	e.membersBySystem.Describe(ch)
+	e.membersByHost.Describe(ch)
+	e.fieldPresent.Describe(ch)
+	e.unreachableByRole.Describe(ch)
+	e.singletonRoleInfo.Describe(ch)
+	e.memberRoles.Describe(ch)
+	e.downSeconds.Describe(ch)
+	e.unreachableSeconds.Describe(ch)
+	e.roleChanges.Describe(ch)
+	e.restarts.Describe(ch)
+	if e.TransitionsAsGauge {
+		e.transitionsGauge.Describe(ch)
+	} else {
+		e.transitions.Describe(ch)
+	}
+	for _, g := range e.clusterGauges {
+		ch <- g.Desc()
+	}
+	for _, g := range e.nodeViewGauges {
+		ch <- g.Desc()
+	}
+	ch <- e.missingRoles.Desc()
+	ch <- e.unexpectedRoles.Desc()
+	ch <- e.membersVsExpected.Desc()
+	ch <- e.viewDisagreement.Desc()
+	ch <- e.circuitOpen.Desc()
 	ch <- e.up.Desc()
+	ch <- e.scrapesSinceSuccess.Desc()
+	ch <- e.observedLeaders.Desc()
+	ch <- e.oldestChanges.Desc()
+	ch <- e.certExpiry.Desc()
+	if !e.SeparateScrapeStats {
+		e.describeScrapeStats(ch)
+	}
+}
+
+func (e *Exporter) describeScrapeStats(ch chan<- *prometheus.Desc) {
+	ch <- e.startTime.Desc()
+	ch <- e.targets.Desc()
+	ch <- e.retries.Desc()
+	ch <- e.scrapeDuration.Desc()
+	ch <- e.connsReused.Desc()
+	ch <- e.connectDuration.Desc()
+	ch <- e.tlsHandshakeDuration.Desc()
+	ch <- e.connsNew.Desc()
+	ch <- e.scrapeAge.Desc()
+	ch <- e.pollInterval.Desc()
+	ch <- e.scrapesInFlight.Desc()
+	ch <- e.fetchErrors.Desc()
+	ch <- e.parseErrors.Desc()
 }
 
 // Collect fetches the stats from configured Akka HTTP Management Endpoint and delivers them
 // as Prometheus metrics. It implements prometheus.Collector.
 func (e *Exporter) Collect(ch chan<- prometheus.Metric) {
+	polling := atomic.LoadInt32(&e.polling) == 1
+	if !polling {
+		e.scrapesInFlight.Inc()
+	}
 	e.mutex.Lock() // To protect metrics from concurrent collects.
 	defer e.mutex.Unlock()
 
-	e.resetMetrics()
-	e.scrape()
+	if !polling {
+		e.timedScrape()
+		e.scrapesInFlight.Dec()
+	}
 
 	ch <- e.up
+	ch <- e.scrapesSinceSuccess
+	ch <- e.observedLeaders
+	ch <- e.oldestChanges
+	if !e.SeparateScrapeStats {
+		e.collectScrapeStats(ch)
+	}
 	e.collectMetrics(ch)
 }
 
-func fetchHTTP(uri string, timeout time.Duration) func() (io.ReadCloser, error) {
-	client := http.Client{
-		Timeout: timeout,
+func (e *Exporter) collectScrapeStats(ch chan<- prometheus.Metric) {
+	if !e.lastScrape.IsZero() {
+		e.scrapeAge.Set(time.Since(e.lastScrape).Seconds())
+		ch <- e.scrapeAge
 	}
-
-	return func() (io.ReadCloser, error) {
-		resp, err := client.Get(uri)
-		if err != nil {
-			return nil, err
-		}
-		if !(resp.StatusCode >= 200 && resp.StatusCode < 300) {
-			resp.Body.Close()
-			return nil, fmt.Errorf("HTTP status %d", resp.StatusCode)
-		}
-		return resp.Body, nil
+	ch <- e.startTime
+	ch <- e.targets
+	ch <- e.pollInterval
+	ch <- e.scrapesInFlight
+	ch <- e.retries
+	ch <- e.scrapeDuration
+	ch <- e.connsReused
+	if strings.HasPrefix(e.URI, "http") {
+		ch <- e.connectDuration
+	}
+	if strings.HasPrefix(e.URI, "https:") {
+		ch <- e.tlsHandshakeDuration
 	}
+	ch <- e.connsNew
+	ch <- e.fetchErrors
+	ch <- e.parseErrors
 }
 
-func (e *Exporter) scrape() {
-	body, err := e.fetch()
-	if err != nil {
-		e.up.Set(0)
-		log.Errorf("Can't scrape akka http management endpoint: %v", err)
-		return
-	}
-	defer body.Close()
-	e.up.Set(1)
+// ScrapeStats returns a collector for the metrics describing the exporter's
+// own scrapes rather than the cluster, such as their duration and errors. It
+// collects without scraping.
+func (e *Exporter) ScrapeStats() prometheus.Collector {
+	return scrapeStats{e}
+}
 
-	var m Cluster
+type scrapeStats struct {
+	e *Exporter
+}
 
-	if b, err := ioutil.ReadAll(body); err == nil {
-		err = json.Unmarshal(b, &m)
-		if err != nil {
-			fmt.Println("error:", err)
-		}
-		e.exportJsonFields(e.serverMetrics, m.Members)
-	}
+func (s scrapeStats) Describe(ch chan<- *prometheus.Desc) {
+	s.e.describeScrapeStats(ch)
 }
 
-// Expose Cluster Membership related metrics
-// Akka Cluster Node States are referenced from here:
-// 	http://doc.akka.io/docs/akka/2.5.3/images/member-states.png
-func (e *Exporter) exportJsonFields(metrics map[int]*prometheus.GaugeVec, members []ClusterNode) {
-	var joining, up, leaving, exiting, removed, down int
-	for _, n := range members {
-		switch n.Status {
-		case "Up":
-			up += 1
-		case "Down":
-			down += 1
-		case "Joining":
-			joining += 1
-		case "Leaving":
-			leaving += 1
-		case "Exiting":
-			exiting += 1
-		case "Removed":
-			removed += 1
-		}
-	}
-	for _, metric := range metrics {
-		metric.WithLabelValues("Up").Set(float64(up))
-		metric.WithLabelValues("Down").Set(float64(down))
-		metric.WithLabelValues("Joining").Set(float64(joining))
-		metric.WithLabelValues("Leaving").Set(float64(leaving))
-		metric.WithLabelValues("Exiting").Set(float64(exiting))
-		metric.WithLabelValues("Removed").Set(float64(removed))
-	}
+func (s scrapeStats) Collect(ch chan<- prometheus.Metric) {
+	s.e.mutex.RLock()
+	defer s.e.mutex.RUnlock()
+	s.e.collectScrapeStats(ch)
 }
 
-func (e *Exporter) resetMetrics() {
-	for _, m := range e.serverMetrics {
-		m.Reset()
+// Poll scrapes the endpoint every interval, decoupling the load on it from
+// how often the exporter is collected. It never returns.
+func (e *Exporter) Poll(interval time.Duration) {
+	atomic.StoreInt32(&e.polling, 1)
+	e.mutex.Lock()
+	e.pollInterval.Set(interval.Seconds())
+	e.mutex.Unlock()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		e.scrapesInFlight.Inc()
+		e.mutex.Lock()
+		e.timedScrape()
+		e.scrapesInFlight.Dec()
+		e.mutex.Unlock()
+		<-ticker.C
 	}
 }
 
-func (e *Exporter) collectMetrics(metrics chan<- prometheus.Metric) {
-	for _, m := range e.serverMetrics {
-		m.Collect(metrics)
+func (e *Exporter) timedScrape() {
+	start := time.Now()
+	e.scrape()
+	e.lastScrape = time.Now()
+	e.scrapeDuration.Observe(e.lastScrape.Sub(start).Seconds())
+}
+
+// newTransport returns the transport shared by all scrapes, keeping up to
+// maxIdleConns idle connections per host for reuse. Hosts with both IPv4 and
+// IPv6 addresses are dialed on both families, the second one starting after
+// fallbackDelay.
+func newTransport(keepAlive time.Duration, maxIdleConns int, idleConnTimeout time.Duration, fallbackDelay time.Duration) *http.Transport {
+	return &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:       30 * time.Second,
+			KeepAlive:     keepAlive,
+			FallbackDelay: fallbackDelay,
+		}).DialContext,
+		MaxIdleConnsPerHost: maxIdleConns,
+		IdleConnTimeout:     idleConnTimeout,
+		TLSHandshakeTimeout: 10 * time.Second,
 	}
 }
 
-func main() {
-	var (
-		listenAddress      = flag.String("web.listen-address", ":9110", "Address to listen on for web interface and telemetry.")
-		metricsPath        = flag.String("web.telemetry-path", "/metrics", "Path under which to expose metrics.")
-		akkaProxyScrapeURI = flag.String("akka.scrape-uri", "http://localhost:19999/members", "URI on which to scrape Akka HTTP Endpoint.")
-		akkaProxyTimeout   = flag.Duration("akka.timeout", 5*time.Second, "Timeout for trying to get stats from Akka HTTP Endpoint.")
-		showVersion        = flag.Bool("version", false, "Print version information.")
-	)
-	flag.Parse()
+// dnsCache resolves host names for dial and caches the addresses for ttl.
+// Failing to dial any of the cached addresses drops them, so that failovers
+// to new addresses are picked up on the next dial.
+type dnsCache struct {
+	ttl  time.Duration
+	dial func(ctx context.Context, network, address string) (net.Conn, error)
 
-	if *showVersion {
-		fmt.Fprintln(os.Stdout, version.Print("akka_cluster_http_management_exporter"))
-		os.Exit(0)
+	mu      sync.Mutex
+	entries map[string]dnsCacheEntry
+}
+
+type dnsCacheEntry struct {
+	addrs     []string
+	expiresAt time.Time
+}
+
+func newDNSCache(ttl time.Duration, dial func(ctx context.Context, network, address string) (net.Conn, error)) *dnsCache {
+	return &dnsCache{
+		ttl:     ttl,
+		dial:    dial,
+		entries: make(map[string]dnsCacheEntry),
 	}
+}
 
-	log.Infoln("Starting akka_cluster_http_management_exporter", version.Info())
-	log.Infoln("Build context", version.BuildContext())
+func (c *dnsCache) lookup(ctx context.Context, host string) ([]string, error) {
+	c.mu.Lock()
+	entry, ok := c.entries[host]
+	c.mu.Unlock()
+	if ok && time.Now().Before(entry.expiresAt) {
+		return entry.addrs, nil
+	}
 
-	exporter, err := NewExporter(*akkaProxyScrapeURI, *akkaProxyTimeout)
+	addrs, err := net.DefaultResolver.LookupHost(ctx, host)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
-	prometheus.MustRegister(exporter)
-	prometheus.MustRegister(version.NewCollector("akka_cluster_http_management_exporter"))
+	c.mu.Lock()
+	c.entries[host] = dnsCacheEntry{addrs: addrs, expiresAt: time.Now().Add(c.ttl)}
+	c.mu.Unlock()
+	return addrs, nil
+}
 
-	log.Infoln("Listening on", *listenAddress)
-	http.Handle(*metricsPath, prometheus.Handler())
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		w.Write([]byte(`<html>
-             <head><title>Akka Cluster HTTP Management Exporter</title></head>
-             <body>
-             <h1>Akka Cluster HTTP Management Exporter</h1>
-             <p><a href='` + *metricsPath + `'>Metrics</a></p>
-             </body>
-             </html>`))
-	})
-	log.Fatal(http.ListenAndServe(*listenAddress, nil))
+func (c *dnsCache) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil || net.ParseIP(host) != nil {
+		return c.dial(ctx, network, address)
+	}
+	addrs, err := c.lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	for _, addr := range addrs {
+		var conn net.Conn
+		if conn, err = c.dial(ctx, network, net.JoinHostPort(addr, port)); err == nil {
+			return conn, nil
+		}
+	}
+	c.mu.Lock()
+	delete(c.entries, host)
+	c.mu.Unlock()
+	return nil, err
+}
+
+// headerRoundTripper sets a header on every request before passing it on.
+type headerRoundTripper struct {
+	name  string
+	value string
+	next  http.RoundTripper
+}
+
+func (rt *headerRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set(rt.name, rt.value)
+	return rt.next.RoundTrip(req)
+}
+
+// bodyRoundTripper turns requests into POST requests carrying a body, for
+// gateways expecting a query. If file is set, the body is read from it on
+// every request so changes apply without a restart.
+type bodyRoundTripper struct {
+	body        string
+	file        string
+	contentType string
+	next        http.RoundTripper
+}
+
+func (rt *bodyRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	body := []byte(rt.body)
+	if rt.file != "" {
+		var err error
+		if body, err = ioutil.ReadFile(rt.file); err != nil {
+			return nil, err
+		}
+	}
+	req = req.Clone(req.Context())
+	req.Method = "POST"
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	req.ContentLength = int64(len(body))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(body)), nil
+	}
+	req.Header.Set("Content-Type", rt.contentType)
+	return rt.next.RoundTrip(req)
+}
+
+// fetchFile reads a recorded membership response from a local file, which is
+// useful for testing and demos without a live endpoint.
+func fetchFile(path string) func(ctx context.Context) (io.ReadCloser, error) {
+	return func(ctx context.Context) (io.ReadCloser, error) {
+		return os.Open(path)
+	}
+}
+
+// credentialsCacheTTL is how long credentials read from files are reused
+// before the files are read again.
+const credentialsCacheTTL = 5 * time.Second
+
+// basicAuthRoundTripper sets basic auth credentials read from files, so that
+// rotated secrets are picked up without a restart.
+type basicAuthRoundTripper struct {
+	usernameFile string
+	passwordFile string
+	next         http.RoundTripper
+
+	mu       sync.Mutex
+	username string
+	password string
+	readAt   time.Time
+	warned   bool
+}
+
+func (rt *basicAuthRoundTripper) credentials() (string, string) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	if time.Since(rt.readAt) < credentialsCacheTTL {
+		return rt.username, rt.password
+	}
+	username, uerr := ioutil.ReadFile(rt.usernameFile)
+	password, perr := ioutil.ReadFile(rt.passwordFile)
+	rt.username = strings.TrimSpace(string(username))
+	rt.password = strings.TrimSpace(string(password))
+	rt.readAt = time.Now()
+
+	if uerr != nil || perr != nil || rt.username == "" || rt.password == "" {
+		if !rt.warned {
+			log.Warnf("Can't read basic auth credentials from %s and %s, scraping without them", rt.usernameFile, rt.passwordFile)
+			rt.warned = true
+		}
+		rt.username, rt.password = "", ""
+	} else {
+		rt.warned = false
+	}
+	return rt.username, rt.password
+}
+
+func (rt *basicAuthRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	username, password := rt.credentials()
+	if username == "" {
+		return rt.next.RoundTrip(req)
+	}
+	req = req.Clone(req.Context())
+	req.SetBasicAuth(username, password)
+	return rt.next.RoundTrip(req)
+}
+
+// fetchHTTP returns a fetch function for the given HTTP(S) URI. The TLS
+// connection state of successful HTTPS responses is passed to onTLS, and
+// every request is traced by a trace from newTrace, if not nil.
+func fetchHTTP(uri string, timeout time.Duration, transport http.RoundTripper, onTLS func(*tls.ConnectionState), newTrace func() *httptrace.ClientTrace) func(ctx context.Context) (io.ReadCloser, error) {
+	client := http.Client{
+		Timeout:   timeout,
+		Transport: transport,
+	}
+
+	return func(ctx context.Context) (io.ReadCloser, error) {
+		if newTrace != nil {
+			ctx = httptrace.WithClientTrace(ctx, newTrace())
+		}
+		req, err := http.NewRequestWithContext(ctx, "GET", uri, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if !(resp.StatusCode >= 200 && resp.StatusCode < 300) {
+			resp.Body.Close()
+			return nil, statusError(resp.StatusCode)
+		}
+		if resp.TLS != nil && onTLS != nil {
+			onTLS(resp.TLS)
+		}
+		return resp.Body, nil
+	}
+}
+
+// statusError is the error of a fetch answered with a non-2xx HTTP status.
+type statusError int
+
+func (code statusError) Error() string {
+	return fmt.Sprintf("HTTP status %d", int(code))
+}
+
+// retryable reports whether a failed fetch may succeed when retried: network
+// errors and timeouts, server errors and being rate limited. Other client
+// errors and errors reading or unwrapping the response won't fix themselves.
+func retryable(err error) bool {
+	var code statusError
+	if errors.As(err, &code) {
+		return code >= 500 || code == http.StatusTooManyRequests
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	// Too many errors implement net.Error, among them url.Error and
+	// syscall.Errno, to tell network errors by it.
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		err = urlErr.Err
+	}
+	var opErr *net.OpError
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	return errors.As(err, &opErr) || errors.As(err, &dnsErr) ||
+		errors.As(err, &netErr) && netErr.Timeout() ||
+		err == io.EOF || err == io.ErrUnexpectedEOF
+}
+
+// clientTrace returns a trace counting whether requests to the endpoint
+// reused a pooled connection, and timing the connection setup of those
+// which didn't.
+func (e *Exporter) clientTrace() *httptrace.ClientTrace {
+	// Dialing both IP families connects to several addresses at once.
+	var mutex sync.Mutex
+	connectStart := make(map[string]time.Time)
+	var tlsStart time.Time
+	return &httptrace.ClientTrace{
+		ConnectStart: func(network, addr string) {
+			mutex.Lock()
+			connectStart[network+addr] = time.Now()
+			mutex.Unlock()
+		},
+		ConnectDone: func(network, addr string, err error) {
+			mutex.Lock()
+			start := connectStart[network+addr]
+			mutex.Unlock()
+			if err == nil {
+				e.connectDuration.Observe(time.Since(start).Seconds())
+			}
+		},
+		TLSHandshakeStart: func() {
+			tlsStart = time.Now()
+		},
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			if err == nil {
+				e.tlsHandshakeDuration.Observe(time.Since(tlsStart).Seconds())
+			}
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Reused {
+				e.connsReused.Inc()
+			} else {
+				e.connsNew.Inc()
+			}
+		},
+	}
+}
+
+// observeTLS records when the certificate served by the endpoint expires.
+func (e *Exporter) observeTLS(state *tls.ConnectionState) {
+	if len(state.PeerCertificates) == 0 {
+		return
+	}
+	e.certExpiry.Set(time.Until(state.PeerCertificates[0].NotAfter).Seconds())
+}
+
+// fetchCluster fetches and parses the current membership without touching
+// any metrics.
+func (e *Exporter) fetchCluster(ctx context.Context) (Cluster, error) {
+	m, err := readCluster(ctx, e.fetch)
+	if err != nil {
+		return m, err
+	}
+	return e.filterView(m), nil
+}
+
+func readCluster(ctx context.Context, fetch func(ctx context.Context) (io.ReadCloser, error)) (Cluster, error) {
+	body, err := fetch(ctx)
+	if err != nil {
+		return Cluster{}, err
+	}
+	defer body.Close()
+	b, err := ioutil.ReadAll(body)
+	if err != nil {
+		return Cluster{}, err
+	}
+	return parseCluster(b)
+}
+
+// fetchConsensus returns a fetch function scraping all given endpoints
+// concurrently and serving the merge of their views as a single response.
+// The statuses are normalized before merging, so they are ranked correctly.
+// The response is the merge encoded again, not what any of the nodes sent.
+func (e *Exporter) fetchConsensus(uris []string, fetches []func(ctx context.Context) (io.ReadCloser, error)) func(ctx context.Context) (io.ReadCloser, error) {
+	return func(ctx context.Context) (io.ReadCloser, error) {
+		views := make([]Cluster, len(fetches))
+		errs := make([]error, len(fetches))
+		var wg sync.WaitGroup
+		for i, fetch := range fetches {
+			wg.Add(1)
+			go func(i int, fetch func(ctx context.Context) (io.ReadCloser, error)) {
+				defer wg.Done()
+				views[i], errs[i] = readCluster(ctx, fetch)
+			}(i, fetch)
+		}
+		wg.Wait()
+
+		var scraped []Cluster
+		var lastErr error
+		for i, err := range errs {
+			if err != nil {
+				log.Warnf("Can't scrape akka http management endpoint %s: %v", redactURI(uris[i]), err)
+				lastErr = err
+				continue
+			}
+			if e.NormalizeStatus {
+				e.normalizeStatuses(views[i].Members)
+			}
+			scraped = append(scraped, views[i])
+		}
+		if len(scraped) == 0 {
+			// The last error is wrapped to decide whether to retry.
+			return nil, fmt.Errorf("none of the %d endpoints could be scraped: %w", len(uris), lastErr)
+		}
+		m, disagreements := mergeClusters(scraped)
+		e.viewDisagreement.Set(float64(disagreements))
+		b, err := json.Marshal(m)
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.NopCloser(bytes.NewReader(b)), nil
+	}
+}
+
+// memberLifecycle orders member statuses by how far a member has progressed
+// through its life in the cluster.
+var memberLifecycle = map[string]int{
+	"Joining":  1,
+	"WeaklyUp": 2,
+	"Up":       3,
+	"Leaving":  4,
+	"Exiting":  5,
+	"Down":     6,
+	"Removed":  7,
+}
+
+// mergeClusters merges several nodes' views of the cluster. Members are
+// matched by their UID, and the most advanced status in their lifecycle wins
+// since gossip only moves members forward. The leader, oldest and self node
+// are taken from the first view. It also returns the number of members
+// whose status differs between the views.
+func mergeClusters(views []Cluster) (Cluster, int) {
+	m := Cluster{
+		SelfNode: views[0].SelfNode,
+		Leader:   views[0].Leader,
+		Oldest:   views[0].Oldest,
+	}
+	members := make(map[string]int)
+	disagree := make(map[string]bool)
+	for _, view := range views {
+		for _, n := range view.Members {
+			key := n.NodeUid
+			if key == "" {
+				key = n.Node
+			}
+			i, ok := members[key]
+			if !ok {
+				members[key] = len(m.Members)
+				m.Members = append(m.Members, n)
+				continue
+			}
+			if m.Members[i].Status != n.Status {
+				disagree[key] = true
+				if memberLifecycle[n.Status] > memberLifecycle[m.Members[i].Status] {
+					m.Members[i] = n
+				}
+			}
+		}
+	}
+
+	unreachable := make(map[string]int)
+	for _, view := range views {
+		for _, n := range view.Unreachable {
+			i, ok := unreachable[n.Node]
+			if !ok {
+				unreachable[n.Node] = len(m.Unreachable)
+				m.Unreachable = append(m.Unreachable, n)
+				continue
+			}
+			for _, observer := range n.ObservedBy {
+				if !containsString(m.Unreachable[i].ObservedBy, observer) {
+					m.Unreachable[i].ObservedBy = append(m.Unreachable[i].ObservedBy, observer)
+				}
+			}
+		}
+	}
+	return m, len(disagree)
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *Exporter) scrape() {
+	ctx := context.Background()
+	if e.CollectTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, e.CollectTimeout)
+		defer cancel()
+	}
+
+	if time.Now().Before(e.circuitOpenUntil) {
+		e.up.Set(0)
+		e.scrapesSinceSuccess.Inc()
+		if !e.KeepLastOnFailure {
+			e.resetMetrics()
+		}
+		return
+	}
+	e.circuitOpen.Set(0)
+
+	body, err := e.fetch(ctx)
+	var permanent bool
+	for retry := 0; err != nil && retry < e.Retries && ctx.Err() == nil; retry++ {
+		if !retryable(err) {
+			permanent = true
+			break
+		}
+		log.Debugf("Retrying scrape of akka http management endpoint after error: %v", err)
+		e.retries.Inc()
+		select {
+		case <-time.After(e.RetryInterval):
+		case <-ctx.Done():
+		}
+		body, err = e.fetch(ctx)
+	}
+	var b []byte
+	var fromDomainEvents bool
+	if err == nil {
+		_, fromDomainEvents = body.(domainEventSnapshot)
+		b, err = ioutil.ReadAll(body)
+		body.Close()
+	}
+	if err != nil {
+		e.up.Set(0)
+		e.fetchErrors.Inc()
+		if permanent {
+			e.logError(fmt.Sprintf("Can't scrape akka http management endpoint, not retrying permanent error: %v", err))
+		} else {
+			e.logError(fmt.Sprintf("Can't scrape akka http management endpoint: %v", err))
+		}
+		e.consecutiveFailures++
+		e.scrapesSinceSuccess.Inc()
+		if e.CircuitBreakerThreshold > 0 && e.consecutiveFailures >= e.CircuitBreakerThreshold {
+			log.Warnf("Not scraping akka http management endpoint for %s after %d consecutive failures", e.CircuitBreakerCooldown, e.consecutiveFailures)
+			e.circuitOpenUntil = time.Now().Add(e.CircuitBreakerCooldown)
+			e.circuitOpen.Set(1)
+		}
+		if !e.KeepLastOnFailure {
+			e.resetMetrics()
+		}
+		return
+	}
+	if e.UpRequiresParse {
+		e.up.Set(0)
+	} else {
+		e.up.Set(1)
+	}
+	if len(b) > maxLastResponseBytes {
+		// Copied, so the rest of the response can be freed.
+		e.lastResponse = append([]byte(nil), b[:maxLastResponseBytes]...)
+	} else {
+		e.lastResponse = b
+	}
+
+	m, err := parseCluster(b)
+	var strictErr error
+	if err == nil && e.StrictJSON != "" {
+		strictErr = checkCluster(b)
+		if strictErr != nil && e.StrictJSON == "fail" {
+			err = strictErr
+		}
+	}
+	if err != nil {
+		// The state tracked across responses is left alone: an
+		// unparseable response says nothing about the cluster.
+		e.parseErrors.Inc()
+		e.scrapesSinceSuccess.Inc()
+		e.logError(fmt.Sprintf("Can't parse akka http management response: %v", err))
+		if !e.KeepLastOnFailure {
+			e.resetMetrics()
+		}
+		e.exportFieldPresence(b)
+		return
+	}
+	// Errors are only considered over once a response could be used, so
+	// repeated parse errors are suppressed like repeated fetch errors.
+	if strictErr != nil {
+		e.logError(fmt.Sprintf("Unexpected field in akka http management response: %v", strictErr))
+	} else {
+		e.resetErrorLog()
+	}
+	e.up.Set(1)
+	e.consecutiveFailures = 0
+	e.scrapesSinceSuccess.Set(0)
+	e.resetMetrics()
+	e.exportFieldPresence(b)
+	e.responseBytes.Set(float64(len(b)))
+
+	m = e.filterView(m)
+	e.state = newClusterState(m, time.Now())
+	e.fromDomainEvents = fromDomainEvents
+
+	statuses := make(map[string]int)
+	for _, n := range m.Members {
+		statuses[n.Status]++
+	}
+	log.With("members", len(m.Members)).
+		With("statuses", statuses).
+		With("leader", m.Leader).
+		With("oldest", m.Oldest).
+		With("unreachable", len(m.Unreachable)).
+		Debug("Scraped akka cluster membership")
+
+	members := m.Members
+	if e.ExcludeSelf {
+		members = withoutNode(members, m.SelfNode)
+	}
+	e.exportJsonFields(e.serverMetrics, members, m.Unreachable)
+	e.exportViewFields(m)
+	// Expectations are about the whole cluster, so the self node counts
+	// even when it's excluded from the member metrics.
+	e.membersVsExpected.Set(float64(len(m.Members) - e.ExpectedSize))
+	if len(e.ExpectedRoles) > 0 {
+		e.exportRoleExpectations(m.Members)
+	}
+	e.trackTransitions(m.Members)
+	e.trackDownMembers(m.Members)
+	e.trackUnreachable(m.Unreachable)
+	e.trackRoleChanges(m.Members)
+	e.trackRestarts(m.Members)
+	e.trackOldest(m.Oldest)
+	e.trackMembership(m.Members)
+	if m.Leader != "" && !e.leaders[m.Leader] {
+		e.leaders[m.Leader] = true
+		e.observedLeaders.Inc()
+	}
+	e.haveData = true
+}
+
+// exportFieldPresence exports which of the responseFields the response has,
+// whether or not it could be parsed.
+func (e *Exporter) exportFieldPresence(b []byte) {
+	_, fields, _ := membersObject(b)
+	for _, field := range responseFields {
+		var present float64
+		if hasField(fields, field) {
+			present = 1
+		}
+		e.fieldPresent.WithLabelValues(field).Set(present)
+	}
+}
+
+// logError logs a scrape error unless the same error was already logged
+// within ErrorLogInterval, so prolonged outages don't flood the log.
+func (e *Exporter) logError(msg string) {
+	if msg == e.lastError && time.Since(e.lastErrorLogged) < e.ErrorLogInterval {
+		e.suppressedErrors++
+		return
+	}
+	switch {
+	case e.suppressedErrors == 0:
+		log.Errorln(msg)
+	case msg == e.lastError:
+		log.Errorf("%s (repeated %d times since last logged)", msg, e.suppressedErrors)
+	default:
+		log.Errorf("%d more times: %s", e.suppressedErrors, e.lastError)
+		log.Errorln(msg)
+	}
+	e.lastError = msg
+	e.lastErrorLogged = time.Now()
+	e.suppressedErrors = 0
+}
+
+func (e *Exporter) resetErrorLog() {
+	if e.suppressedErrors > 0 {
+		log.Infof("Scrape succeeded after %d unlogged repetitions of: %s", e.suppressedErrors, e.lastError)
+	}
+	e.lastError = ""
+	e.suppressedErrors = 0
+}
+
+// Expose Cluster Membership related metrics
+// Akka Cluster Node States are referenced from here:
+// 	http://doc.akka.io/docs/akka/2.5.3/images/member-states.png
+func (e *Exporter) exportJsonFields(metrics map[int]*prometheus.GaugeVec, members []ClusterNode, unreachable []ClusterNode) {
+	statuses := e.Statuses
+	if len(statuses) == 0 {
+		statuses = memberStatuses
+	}
+	counts := make(map[string]int, len(memberStatuses))
+	dataCenters := make(map[string]bool)
+	var missingUID, roleAssignments int
+	roleMembers := make(map[string]int)
+	for _, n := range members {
+		counts[n.Status] += 1
+		// The dc- role Akka assigns to every member isn't counted.
+		for _, role := range n.Roles {
+			if !strings.HasPrefix(role, "dc-") {
+				roleAssignments++
+				roleMembers[role]++
+			}
+		}
+		if n.NodeUid == "" {
+			missingUID++
+		}
+		dataCenters[dataCenter(n)] = true
+		// A member whose system name differs from its peers' joined with
+		// the wrong configuration, and several members on one host defeat
+		// anti-affinity.
+		system, host, _, err := parseNodeAddress(n.Node)
+		if err != nil {
+			system, host = "unknown", "unknown"
+		}
+		e.membersBySystem.WithLabelValues(system).Inc()
+		e.membersByHost.WithLabelValues(host).Inc()
+		if e.RoleMetrics {
+			for _, role := range n.Roles {
+				if e.sanitizeNodeLabel {
+					e.memberRoles.WithLabelValues(nodeLabelReplacer.Replace(n.Node), n.Node, role).Set(1)
+				} else {
+					e.memberRoles.WithLabelValues(n.Node, role).Set(1)
+				}
+			}
+		}
+	}
+	e.dataCenters.Set(float64(len(dataCenters)))
+	e.distinctStatuses.Set(float64(len(counts)))
+	e.missingUID.Set(float64(missingUID))
+	var avgRoles float64
+	if len(members) > 0 {
+		avgRoles = float64(roleAssignments) / float64(len(members))
+	}
+	e.avgRoles.Set(avgRoles)
+
+	// A role held by a single member is lost along with it.
+	var singletonRoles int
+	for role, n := range roleMembers {
+		if n == 1 {
+			singletonRoles++
+			e.singletonRoleInfo.WithLabelValues(role).Set(1)
+		}
+	}
+	e.singletonRoles.Set(float64(singletonRoles))
+	e.departing.Set(float64(counts["Leaving"] + counts["Exiting"]))
+	for _, metric := range metrics {
+		for _, status := range statuses {
+			metric.WithLabelValues(status).Set(float64(counts[status]))
+		}
+	}
+
+	// Ratios are relative to every member in the view, so they stay
+	// comparable across clusters of different sizes.
+	total := len(members)
+	for _, status := range statuses {
+		var ratio float64
+		if total > 0 {
+			ratio = float64(counts[status]) / float64(total)
+		}
+		e.statusRatio.WithLabelValues(status).Set(ratio)
+	}
+
+	// A node marked unreachable by a single observer hints at a local
+	// perception problem, while many observers agreeing hint at a partition.
+	var observers int
+	for _, n := range unreachable {
+		observers += len(n.ObservedBy)
+	}
+	e.unreachableObservers.Set(float64(observers))
+
+	roles := make(map[string][]string, len(members))
+	memberStatus := make(map[string]string, len(members))
+	for _, n := range members {
+		roles[n.Node] = n.Roles
+		memberStatus[n.Node] = n.Status
+	}
+	// Up members that are unreachable are what a split brain resolver acts
+	// on, so they are the ones about to be downed.
+	var upButUnreachable int
+	for _, n := range unreachable {
+		nodeRoles, ok := roles[n.Node]
+		if !ok {
+			nodeRoles = []string{"unknown"}
+		}
+		for _, role := range nodeRoles {
+			e.unreachableByRole.WithLabelValues(role).Inc()
+		}
+		if memberStatus[n.Node] == "Up" {
+			upButUnreachable++
+		}
+	}
+	e.upButUnreachable.Set(float64(upButUnreachable))
+
+	// Nodes observed as unreachable by only a minority of the reachable
+	// members are more likely false positives of a flaky observer than
+	// a partition.
+	reachable := len(members)
+	for _, n := range unreachable {
+		if _, ok := memberStatus[n.Node]; ok {
+			reachable--
+		}
+	}
+	var minority int
+	for _, n := range unreachable {
+		if 2*len(n.ObservedBy) < reachable {
+			minority++
+		}
+	}
+	e.minorityUnreachable.Set(float64(minority))
+}
+
+// exportViewFields exports metrics about the view of the cluster as seen by
+// the scraped node itself.
+func (e *Exporter) exportViewFields(m Cluster) {
+	var selfPresent float64
+	for _, n := range m.Members {
+		if n.Node == m.SelfNode {
+			selfPresent = 1
+			break
+		}
+	}
+	e.selfNodePresent.Set(selfPresent)
+
+	var hasLeader float64
+	if m.Leader != "" {
+		hasLeader = 1
+	}
+	e.hasLeader.Set(hasLeader)
+
+	// During a rolling upgrade, members running another version than the
+	// scraped node are the ones left to upgrade, or already upgraded. Unknown
+	// versions are taken as matching.
+	var selfVersion string
+	for _, n := range m.Members {
+		if n.Node == m.SelfNode {
+			selfVersion = n.AppVersion
+		}
+	}
+	var skew int
+	for _, n := range m.Members {
+		if selfVersion != "" && n.AppVersion != "" && n.AppVersion != selfVersion {
+			skew++
+		}
+	}
+	e.appVersionSkew.Set(float64(skew))
+
+	// The oldest member hosts the cluster singletons.
+	var selfIsOldest float64
+	if m.Oldest != "" && m.Oldest == m.SelfNode {
+		selfIsOldest = 1
+	}
+	e.selfIsOldest.Set(selfIsOldest)
+
+	// Unreachable nodes are expected to be members until they are removed,
+	// anything else is an inconsistent gossip view.
+	var orphans int
+	for _, u := range m.Unreachable {
+		found := false
+		for _, n := range m.Members {
+			if n.Node == u.Node {
+				found = true
+				break
+			}
+		}
+		if !found {
+			orphans++
+		}
+	}
+	e.unreachableNotInMembers.Set(float64(orphans))
+}
+
+// normalizeStatus returns the canonical spelling of the given member status.
+// Unknown statuses are returned unchanged and logged once.
+func (e *Exporter) normalizeStatus(status string) string {
+	key := strings.ToLower(strings.NewReplacer(" ", "", "_", "", "-", "").Replace(status))
+	if canonical, ok := canonicalStatuses[key]; ok {
+		return canonical
+	}
+	e.statusesMutex.Lock()
+	defer e.statusesMutex.Unlock()
+	if !e.unknownStatuses[status] {
+		log.Warnf("Unknown akka member status %q, exporting it unchanged", status)
+		e.unknownStatuses[status] = true
+	}
+	return status
+}
+
+// filterView applies NormalizeStatus and DropRemoved to a parsed response, so
+// scrapes, /diff and -check all see the same view. It doesn't take the
+// mutex, which scrape holds when calling it.
+func (e *Exporter) filterView(m Cluster) Cluster {
+	if e.NormalizeStatus {
+		e.normalizeStatuses(m.Members)
+	}
+	if e.DropRemoved {
+		m = withoutRemoved(m)
+	}
+	return m
+}
+
+// normalizeStatuses replaces the status of every member with its canonical
+// spelling.
+func (e *Exporter) normalizeStatuses(members []ClusterNode) {
+	for i := range members {
+		members[i].Status = e.normalizeStatus(members[i].Status)
+	}
+}
+
+// withoutNode returns the members other than the given node.
+func withoutNode(members []ClusterNode, node string) []ClusterNode {
+	peers := make([]ClusterNode, 0, len(members))
+	for _, n := range members {
+		if n.Node != node {
+			peers = append(peers, n)
+		}
+	}
+	return peers
+}
+
+// withoutRemoved returns the view without Removed members, and without
+// unreachable entries for them, which would otherwise look like nodes
+// missing from the members.
+func withoutRemoved(m Cluster) Cluster {
+	removed := make(map[string]bool)
+	members := make([]ClusterNode, 0, len(m.Members))
+	for _, n := range m.Members {
+		if n.Status == "Removed" {
+			removed[n.Node] = true
+		} else {
+			members = append(members, n)
+		}
+	}
+	m.Members = members
+	if len(removed) > 0 {
+		unreachable := make([]ClusterNode, 0, len(m.Unreachable))
+		for _, n := range m.Unreachable {
+			if !removed[n.Node] {
+				unreachable = append(unreachable, n)
+			}
+		}
+		m.Unreachable = unreachable
+	}
+	return m
+}
+
+// exportRoleExpectations compares the roles held by members with
+// ExpectedRoles. The dc-<name> roles Akka adds to every member are ignored.
+func (e *Exporter) exportRoleExpectations(members []ClusterNode) {
+	expected := make(map[string]bool, len(e.ExpectedRoles))
+	for _, role := range e.ExpectedRoles {
+		expected[role] = true
+	}
+	observed := make(map[string]bool)
+	for _, n := range members {
+		for _, role := range n.Roles {
+			if !strings.HasPrefix(role, "dc-") {
+				observed[role] = true
+			}
+		}
+	}
+
+	var missing, unexpected int
+	for role := range expected {
+		if !observed[role] {
+			missing++
+		}
+	}
+	for role := range observed {
+		if !expected[role] {
+			unexpected++
+		}
+	}
+	e.missingRoles.Set(float64(missing))
+	e.unexpectedRoles.Set(float64(unexpected))
+}
+
+// trackTransitions compares each member's status with the one seen on the
+// previous scrape. Members seen for the first time don't count as a transition.
+func (e *Exporter) trackTransitions(members []ClusterNode) {
+	statuses := statusesByNode(members)
+	for _, c := range diffMembers(e.lastStatuses, statuses).Changed {
+		if e.TransitionsAsGauge {
+			e.transitionsGauge.WithLabelValues(c.From, c.To).Inc()
+		} else {
+			e.transitions.WithLabelValues(c.From, c.To).Inc()
+		}
+	}
+	e.lastStatuses = statuses
+}
+
+// statusesByNode returns the status of each member keyed by its address.
+func statusesByNode(members []ClusterNode) map[string]string {
+	statuses := make(map[string]string, len(members))
+	for _, n := range members {
+		statuses[n.Node] = n.Status
+	}
+	return statuses
+}
+
+// statusChange is a member whose status differs between two views.
+type statusChange struct {
+	Node string `json:"node"`
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// membershipDiff describes how the members changed between two views.
+type membershipDiff struct {
+	Joined  []string       `json:"joined"`
+	Left    []string       `json:"left"`
+	Changed []statusChange `json:"changed"`
+}
+
+// diffMembers compares two views of member statuses keyed by address. The
+// result is sorted by address.
+func diffMembers(previous, current map[string]string) membershipDiff {
+	d := membershipDiff{
+		Joined:  []string{},
+		Left:    []string{},
+		Changed: []statusChange{},
+	}
+	for node, status := range current {
+		prev, ok := previous[node]
+		switch {
+		case !ok:
+			d.Joined = append(d.Joined, node)
+		case prev != status:
+			d.Changed = append(d.Changed, statusChange{Node: node, From: prev, To: status})
+		}
+	}
+	for node := range previous {
+		if _, ok := current[node]; !ok {
+			d.Left = append(d.Left, node)
+		}
+	}
+	sort.Strings(d.Joined)
+	sort.Strings(d.Left)
+	sort.Slice(d.Changed, func(i, j int) bool { return d.Changed[i].Node < d.Changed[j].Node })
+	return d
+}
+
+// uidRetention is how long the UID of an address gone from the members is
+// kept. Addresses such as pod IPs change on every reschedule, so they can't
+// be kept for the life of the process.
+const uidRetention = time.Hour
+
+// trackRestarts counts members whose UID differs from the last one seen for
+// their address. Members without a UID are skipped.
+func (e *Exporter) trackRestarts(members []ClusterNode) {
+	now := time.Now()
+	for _, n := range members {
+		if n.NodeUid == "" {
+			continue
+		}
+		if prev, ok := e.uids[n.Node]; ok && prev != n.NodeUid {
+			e.restarts.WithLabelValues(n.Node).Inc()
+		}
+		e.uids[n.Node] = n.NodeUid
+		e.uidsSeen[n.Node] = now
+	}
+	for node, seen := range e.uidsSeen {
+		if now.Sub(seen) > uidRetention {
+			delete(e.uids, node)
+			delete(e.uidsSeen, node)
+		}
+	}
+}
+
+// trackRoleChanges counts members whose set of roles differs from the one
+// seen on the previous scrape.
+func (e *Exporter) trackRoleChanges(members []ClusterNode) {
+	roles := make(map[string]string, len(members))
+	for _, n := range members {
+		sorted := append([]string(nil), n.Roles...)
+		sort.Strings(sorted)
+		roles[n.Node] = strings.Join(sorted, ",")
+		if prev, ok := e.lastRoles[n.Node]; ok && prev != roles[n.Node] {
+			e.roleChanges.WithLabelValues(n.Node).Inc()
+		}
+	}
+	e.lastRoles = roles
+}
+
+// trackOldest counts changes of the oldest member. The first one seen isn't
+// a change, and responses without one are ignored.
+func (e *Exporter) trackOldest(oldest string) {
+	if oldest != "" && oldest != e.lastOldest {
+		if e.lastOldest != "" {
+			e.oldestChanges.Inc()
+		}
+		e.lastOldest = oldest
+		e.oldestChangedAt = time.Now()
+	}
+	if !e.oldestChangedAt.IsZero() {
+		e.sinceOldestChange.Set(time.Since(e.oldestChangedAt).Seconds())
+	}
+}
+
+// trackMembership notes when the members or their statuses last differed
+// from the previous scrape, comparing hashes of the sorted views.
+func (e *Exporter) trackMembership(members []ClusterNode) {
+	statuses := statusesByNode(members)
+	nodes := make([]string, 0, len(statuses))
+	for node := range statuses {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+	h := fnv.New64a()
+	for _, node := range nodes {
+		fmt.Fprintf(h, "%s\x00%s\x00", node, statuses[node])
+	}
+	if sum := h.Sum64(); sum != e.membershipHash || e.membershipChangedAt.IsZero() {
+		e.membershipHash = sum
+		e.membershipChangedAt = time.Now()
+	}
+	e.sinceMembershipChange.Set(time.Since(e.membershipChangedAt).Seconds())
+}
+
+// trackDownMembers reports the members that were already Down on the previous
+// scrape, along with how long they have been Down since first seen that way.
+func (e *Exporter) trackDownMembers(members []ClusterNode) {
+	now := time.Now()
+	downSince := make(map[string]time.Time)
+	stuck := 0
+	for _, n := range members {
+		if n.Status != "Down" {
+			continue
+		}
+		since, ok := e.downSince[n.Node]
+		if !ok {
+			downSince[n.Node] = now
+			continue
+		}
+		downSince[n.Node] = since
+		e.downSeconds.WithLabelValues(n.Node).Set(now.Sub(since).Seconds())
+		stuck++
+	}
+	e.stuckDown.Set(float64(stuck))
+	e.downSince = downSince
+}
+
+// trackUnreachable reports how long each node has been continuously
+// unreachable since first seen that way, and the longest of these.
+func (e *Exporter) trackUnreachable(unreachable []ClusterNode) {
+	now := time.Now()
+	unreachableSince := make(map[string]time.Time, len(unreachable))
+	var max float64
+	for _, n := range unreachable {
+		since, ok := e.unreachableSince[n.Node]
+		if !ok {
+			since = now
+		}
+		unreachableSince[n.Node] = since
+		seconds := now.Sub(since).Seconds()
+		e.unreachableSeconds.WithLabelValues(n.Node).Set(seconds)
+		if seconds > max {
+			max = seconds
+		}
+	}
+	e.maxUnreachable.Set(max)
+	e.unreachableSince = unreachableSince
+}
+
+func (e *Exporter) resetMetrics() {
+	for _, m := range e.serverMetrics {
+		m.Reset()
+	}
+	e.statusRatio.Reset()
+	e.membersBySystem.Reset()
+	e.membersByHost.Reset()
+	e.fieldPresent.Reset()
+	e.unreachableByRole.Reset()
+	e.singletonRoleInfo.Reset()
+	e.memberRoles.Reset()
+	e.downSeconds.Reset()
+	e.unreachableSeconds.Reset()
+	e.transitionsGauge.Reset()
+	e.haveData = false
+}
+
+func (e *Exporter) collectMetrics(metrics chan<- prometheus.Metric) {
+	for _, m := range e.serverMetrics {
+		m.Collect(metrics)
+	}
+	e.statusRatio.Collect(metrics)
+	e.membersBySystem.Collect(metrics)
+	e.membersByHost.Collect(metrics)
+	e.fieldPresent.Collect(metrics)
+	e.unreachableByRole.Collect(metrics)
+	e.singletonRoleInfo.Collect(metrics)
+	e.memberRoles.Collect(metrics)
+	e.downSeconds.Collect(metrics)
+	e.unreachableSeconds.Collect(metrics)
+	e.roleChanges.Collect(metrics)
+	e.restarts.Collect(metrics)
+	if e.TransitionsAsGauge {
+		e.transitionsGauge.Collect(metrics)
+	} else {
+		e.transitions.Collect(metrics)
+	}
+	if e.CircuitBreakerThreshold > 0 {
+		metrics <- e.circuitOpen
+	}
+	if e.haveData {
+		for _, g := range e.clusterGauges {
+			metrics <- g
+		}
+		if !e.fromDomainEvents {
+			for _, g := range e.nodeViewGauges {
+				metrics <- g
+			}
+		}
+		if len(e.ExpectedRoles) > 0 {
+			metrics <- e.missingRoles
+			metrics <- e.unexpectedRoles
+		}
+		if e.ExpectedSize > 0 {
+			metrics <- e.membersVsExpected
+		}
+		if strings.HasPrefix(e.URI, "https:") {
+			metrics <- e.certExpiry
+		}
+		if e.consensus {
+			metrics <- e.viewDisagreement
+		}
+	}
+}
+
+// expandEnv replaces ${VAR} and $VAR references in s with the values of the
+// corresponding environment variables. Unset variables are an error.
+func expandEnv(s string) (string, error) {
+	var missing []string
+	expanded := os.Expand(s, func(name string) string {
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			missing = append(missing, name)
+		}
+		return value
+	})
+	if len(missing) > 0 {
+		return "", fmt.Errorf("unset environment variables in %q: %s", s, strings.Join(missing, ", "))
+	}
+	return expanded, nil
+}
+
+// metricInfo is the name and help string of an exported metric.
+type metricInfo struct {
+	Name string `json:"name"`
+	Help string `json:"help"`
+}
+
+// describeMetrics returns the metrics described by the given collectors,
+// sorted by name.
+func describeMetrics(collectors ...prometheus.Collector) ([]metricInfo, error) {
+	ch := make(chan *prometheus.Desc)
+	go func() {
+		for _, c := range collectors {
+			c.Describe(ch)
+		}
+		close(ch)
+	}()
+
+	var descs []*prometheus.Desc
+	for d := range ch {
+		descs = append(descs, d)
+	}
+
+	infos := make([]metricInfo, 0, len(descs))
+	for _, d := range descs {
+		info, err := parseDesc(d)
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos, nil
+}
+
+// parseDesc returns the name and help string of the given descriptor. Desc
+// keeps its fields private, so they are parsed from its string form.
+func parseDesc(d *prometheus.Desc) (metricInfo, error) {
+	var info metricInfo
+	if _, err := fmt.Sscanf(d.String(), "Desc{fqName: %q, help: %q,", &info.Name, &info.Help); err != nil {
+		return info, fmt.Errorf("can't parse %s: %v", d, err)
+	}
+	return info, nil
+}
+
+// gatherMetrics collects the current metrics of the given collectors.
+func gatherMetrics(collectors ...prometheus.Collector) []prometheus.Metric {
+	ch := make(chan prometheus.Metric)
+	go func() {
+		for _, c := range collectors {
+			c.Collect(ch)
+		}
+		close(ch)
+	}()
+
+	var metrics []prometheus.Metric
+	for m := range ch {
+		metrics = append(metrics, m)
+	}
+	return metrics
+}
+
+// helpAnnotator wraps a collector, appending a suffix to the help strings of
+// its metrics.
+type helpAnnotator struct {
+	prometheus.Collector
+	suffix string
+
+	mutex sync.Mutex
+	descs map[*prometheus.Desc]*prometheus.Desc
+}
+
+func newHelpAnnotator(c prometheus.Collector, suffix string) *helpAnnotator {
+	return &helpAnnotator{
+		Collector: c,
+		suffix:    suffix,
+		descs:     make(map[*prometheus.Desc]*prometheus.Desc),
+	}
+}
+
+func (a *helpAnnotator) Describe(ch chan<- *prometheus.Desc) {
+	descs := make(chan *prometheus.Desc)
+	go func() {
+		a.Collector.Describe(descs)
+		close(descs)
+	}()
+	for d := range descs {
+		ch <- a.annotate(d)
+	}
+}
+
+func (a *helpAnnotator) Collect(ch chan<- prometheus.Metric) {
+	metrics := make(chan prometheus.Metric)
+	go func() {
+		a.Collector.Collect(metrics)
+		close(metrics)
+	}()
+	for m := range metrics {
+		ch <- annotatedMetric{m, a.annotate(m.Desc())}
+	}
+}
+
+// annotate returns d with the suffix appended to its help string. Descs
+// with constant labels, which can't be recovered from a Desc, are returned
+// unchanged.
+func (a *helpAnnotator) annotate(d *prometheus.Desc) *prometheus.Desc {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if annotated, ok := a.descs[d]; ok {
+		return annotated
+	}
+
+	annotated := d
+	s := d.String()
+	info, err := parseDesc(d)
+	if err == nil && strings.Contains(s, "constLabels: {}") {
+		labels := s[strings.LastIndex(s, "variableLabels: [")+len("variableLabels: [") : len(s)-len("]}")]
+		annotated = prometheus.NewDesc(info.Name, info.Help+a.suffix, strings.Fields(labels), nil)
+	}
+	a.descs[d] = annotated
+	return annotated
+}
+
+type annotatedMetric struct {
+	prometheus.Metric
+	desc *prometheus.Desc
+}
+
+func (m annotatedMetric) Desc() *prometheus.Desc {
+	return m.desc
+}
+
+// parseBuckets parses a comma separated list of increasing histogram buckets.
+func parseBuckets(s string) ([]float64, error) {
+	var buckets []float64
+	for _, f := range strings.Split(s, ",") {
+		b, err := strconv.ParseFloat(strings.TrimSpace(f), 64)
+		if err != nil {
+			return nil, err
+		}
+		if len(buckets) > 0 && b <= buckets[len(buckets)-1] {
+			return nil, fmt.Errorf("buckets must be in increasing order: %q", s)
+		}
+		buckets = append(buckets, b)
+	}
+	return buckets, nil
+}
+
+// parseStatuses parses a comma separated list of member statuses, as spelled
+// by Akka.
+func parseStatuses(s string) ([]string, error) {
+	var statuses []string
+	for _, f := range strings.Split(s, ",") {
+		status := strings.TrimSpace(f)
+		if status == "" {
+			return nil, fmt.Errorf("empty status in %q", s)
+		}
+		if !containsString(memberStatuses, status) {
+			return nil, fmt.Errorf("unknown status %q, expected one of %s", status, strings.Join(memberStatuses, ", "))
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+// parseRoles parses a comma separated list of member roles.
+func parseRoles(s string) ([]string, error) {
+	var roles []string
+	for _, f := range strings.Split(s, ",") {
+		role := strings.TrimSpace(f)
+		if role == "" {
+			return nil, fmt.Errorf("empty role in %q", s)
+		}
+		roles = append(roles, role)
+	}
+	return roles, nil
+}
+
+// stringsFlag is a flag.Value collecting every occurrence of a repeated flag.
+type stringsFlag []string
+
+func (f *stringsFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *stringsFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+// listenAndServe serves handler on every address until SIGINT or SIGTERM is
+// received, then shuts all servers down gracefully. It fails if any of the
+// addresses can't be bound.
+func listenAndServe(handlers map[string]http.Handler, readTimeout, writeTimeout, idleTimeout time.Duration) error {
+	listeners := make(map[net.Listener]http.Handler, len(handlers))
+	for address, handler := range handlers {
+		l, err := net.Listen("tcp", address)
+		if err != nil {
+			for l := range listeners {
+				l.Close()
+			}
+			return err
+		}
+		listeners[l] = handler
+	}
+
+	errs := make(chan error, len(listeners))
+	servers := make([]*http.Server, 0, len(listeners))
+	for l, handler := range listeners {
+		srv := &http.Server{
+			Handler:      handler,
+			ReadTimeout:  readTimeout,
+			WriteTimeout: writeTimeout,
+			IdleTimeout:  idleTimeout,
+		}
+		servers = append(servers, srv)
+		go func(srv *http.Server, l net.Listener) {
+			errs <- srv.Serve(l)
+		}(srv, l)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	var err error
+	select {
+	case err = <-errs:
+	case sig := <-signals:
+		log.Infoln("Received", sig, "shutting down")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, srv := range servers {
+		srv.Shutdown(ctx)
+	}
+	return err
+}
+
+// maxDiffInterval caps the interval requested from /diff.
+const maxDiffInterval = time.Minute
+
+// maxLastResponseBytes bounds the memory kept for /debug/last-response.
+const maxLastResponseBytes = 1 << 20
+
+// LastResponse returns the last response read from the endpoint, truncated
+// to maxLastResponseBytes, or nil if there is none yet.
+func (e *Exporter) LastResponse() []byte {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+	return e.lastResponse
+}
+
+// clusterState is the JSON view of the cluster served on /state, with the
+// field names used by Akka HTTP Endpoint.
+type clusterState struct {
+	ScrapedAt   time.Time          `json:"scrapedAt"`
+	SelfNode    string             `json:"selfNode"`
+	Leader      string             `json:"leader"`
+	Oldest      string             `json:"oldest"`
+	Members     []memberState      `json:"members"`
+	Unreachable []unreachableState `json:"unreachable"`
+	Health      clusterHealth      `json:"health"`
+}
+
+type memberState struct {
+	Node       string   `json:"node"`
+	NodeUid    string   `json:"nodeUid"`
+	Status     string   `json:"status"`
+	Roles      []string `json:"roles"`
+	DataCenter string   `json:"dataCenter"`
+}
+
+type unreachableState struct {
+	Node       string   `json:"node"`
+	ObservedBy []string `json:"observedBy"`
+}
+
+// clusterHealth holds the health flags also exported as metrics.
+type clusterHealth struct {
+	HasLeader        bool `json:"hasLeader"`
+	SelfNodePresent  bool `json:"selfNodePresent"`
+	AllUp            bool `json:"allUp"`
+	Unreachable      int  `json:"unreachable"`
+	UpButUnreachable int  `json:"upButUnreachable"`
+}
+
+func newClusterState(m Cluster, scrapedAt time.Time) *clusterState {
+	s := &clusterState{
+		ScrapedAt:   scrapedAt,
+		SelfNode:    m.SelfNode,
+		Leader:      m.Leader,
+		Oldest:      m.Oldest,
+		Members:     make([]memberState, len(m.Members)),
+		Unreachable: make([]unreachableState, len(m.Unreachable)),
+		Health: clusterHealth{
+			HasLeader:   m.Leader != "",
+			AllUp:       true,
+			Unreachable: len(m.Unreachable),
+		},
+	}
+	statuses := make(map[string]string, len(m.Members))
+	for i, n := range m.Members {
+		s.Members[i] = memberState{
+			Node:       n.Node,
+			NodeUid:    n.NodeUid,
+			Status:     n.Status,
+			Roles:      n.Roles,
+			DataCenter: dataCenter(n),
+		}
+		statuses[n.Node] = n.Status
+		if n.Node == m.SelfNode {
+			s.Health.SelfNodePresent = true
+		}
+		if n.Status != "Up" {
+			s.Health.AllUp = false
+		}
+	}
+	for i, n := range m.Unreachable {
+		s.Unreachable[i] = unreachableState{Node: n.Node, ObservedBy: n.ObservedBy}
+		if statuses[n.Node] == "Up" {
+			s.Health.UpButUnreachable++
+		}
+	}
+	return s
+}
+
+// State returns the view of the cluster parsed from the last successful
+// scrape, or nil if there was none yet.
+func (e *Exporter) State() *clusterState {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+	return e.state
+}
+
+// serveDiff scrapes the endpoint twice, interval apart, and responds with the
+// membership changes in between. The interval can be overridden with the
+// interval query parameter.
+func serveDiff(w http.ResponseWriter, r *http.Request, e *Exporter, interval time.Duration) {
+	if v := r.URL.Query().Get("interval"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 || d > maxDiffInterval {
+			http.Error(w, fmt.Sprintf("invalid interval %q, must be between 0s and %s", v, maxDiffInterval), http.StatusBadRequest)
+			return
+		}
+		interval = d
+	}
+
+	before, err := e.fetchCluster(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	select {
+	case <-time.After(interval):
+	case <-r.Context().Done():
+		return
+	}
+	after, err := e.fetchCluster(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(diffMembers(statusesByNode(before.Members), statusesByNode(after.Members)))
+}
+
+// collectorHandler serves the metrics of the given collectors, like
+// prometheus.Handler does for the registered ones.
+func collectorHandler(collectors ...prometheus.Collector) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		families, err := gatherFamilies(collectors...)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		format := expfmt.Negotiate(r.Header)
+		w.Header().Set("Content-Type", string(format))
+		enc := expfmt.NewEncoder(w, format)
+		for _, mf := range families {
+			if err := enc.Encode(mf); err != nil {
+				log.Errorf("Can't encode metrics: %v", err)
+				return
+			}
+		}
+	})
+}
+
+// gatherFamilies collects the given collectors into metric families, sorted
+// by name.
+func gatherFamilies(collectors ...prometheus.Collector) ([]*dto.MetricFamily, error) {
+	byName := make(map[string]*dto.MetricFamily)
+	for _, m := range gatherMetrics(collectors...) {
+		info, err := parseDesc(m.Desc())
+		if err != nil {
+			return nil, err
+		}
+		metric := &dto.Metric{}
+		if err := m.Write(metric); err != nil {
+			return nil, err
+		}
+		mf, ok := byName[info.Name]
+		if !ok {
+			mf = &dto.MetricFamily{
+				Name: proto.String(info.Name),
+				Help: proto.String(info.Help),
+				Type: metricType(metric).Enum(),
+			}
+			byName[info.Name] = mf
+		}
+		mf.Metric = append(mf.Metric, metric)
+	}
+
+	names := make([]string, 0, len(byName))
+	for name := range byName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	families := make([]*dto.MetricFamily, len(names))
+	for i, name := range names {
+		families[i] = byName[name]
+	}
+	return families, nil
+}
+
+func metricType(m *dto.Metric) dto.MetricType {
+	switch {
+	case m.Gauge != nil:
+		return dto.MetricType_GAUGE
+	case m.Counter != nil:
+		return dto.MetricType_COUNTER
+	case m.Summary != nil:
+		return dto.MetricType_SUMMARY
+	case m.Histogram != nil:
+		return dto.MetricType_HISTOGRAM
+	default:
+		return dto.MetricType_UNTYPED
+	}
+}
+
+// withoutCompression makes handler respond uncompressed, by hiding from it
+// that the client accepts gzip.
+func withoutCompression(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Header.Del("Accept-Encoding")
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// versionInfo is the build information served on /version.
+type versionInfo struct {
+	Version   string `json:"version"`
+	Revision  string `json:"revision"`
+	Branch    string `json:"branch"`
+	BuildUser string `json:"build_user"`
+	BuildDate string `json:"build_date"`
+	GoVersion string `json:"go_version"`
+}
+
+// effectiveConfig is the configuration served on the /config endpoint.
+// Secrets must never be stored in it unredacted.
+type effectiveConfig struct {
+	ScrapeURI             string   `json:"scrape_uri"`
+	Timeout               string   `json:"timeout"`
+	TLS                   bool     `json:"tls"`
+	Auth                  bool     `json:"auth"`
+	TransitionsMetricType string   `json:"transitions_metric_type"`
+	KeepLastOnFailure     bool     `json:"keep_last_on_failure"`
+	JSONRoot              string   `json:"json_root"`
+	UpRequiresParse       bool     `json:"up_requires_parse"`
+	ExcludeSelf           bool     `json:"exclude_self"`
+	DropRemoved           bool     `json:"drop_removed"`
+	RoleMetrics           bool     `json:"role_metrics"`
+	NormalizeStatus       bool     `json:"normalize_status"`
+	Statuses              string   `json:"statuses"`
+	ExpectedRoles         string   `json:"expected_roles"`
+	ExpectedSize          int      `json:"expected_size"`
+	Retries               int      `json:"retries"`
+	RetryInterval         string   `json:"retry_interval"`
+	CollectTimeout        string   `json:"collect_timeout"`
+	PollInterval          string   `json:"poll_interval"`
+	ConsensusURIs         []string `json:"consensus_uris,omitempty"`
+}
+
+// redactURI replaces the password of the given URI, if any, with <redacted>.
+func redactURI(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil || u.User == nil {
+		return uri
+	}
+	if _, ok := u.User.Password(); !ok {
+		return uri
+	}
+	u.User = url.User(u.User.Username())
+	return strings.Replace(u.String(), "@", ":<redacted>@", 1)
+}
+
+func main() {
+	var (
+		listenAddresses     stringsFlag
+		consensusURIs       stringsFlag
+		fieldMappings       stringsFlag
+		metricsPath         = flag.String("web.telemetry-path", "/metrics", "Path under which to expose metrics.")
+		akkaProxyScrapeURI  = flag.String("akka.scrape-uri", "http://localhost:19999/members", "URI on which to scrape Akka HTTP Endpoint. ${VAR} references are replaced with environment variables.")
+		akkaProxyTimeout    = flag.Duration("akka.timeout", 5*time.Second, "Timeout for trying to get stats from Akka HTTP Endpoint.")
+		akkaTransitions     = flag.String("akka.transitions-metric-type", "counter", "Export member status transitions as a \"counter\" or as a \"gauge\" reset on each scrape.")
+		showVersion         = flag.Bool("version", false, "Print version information.")
+		akkaRetries         = flag.Int("akka.retries", 0, "Number of times a failed fetch from Akka HTTP Endpoint is retried within a scrape.")
+		akkaRetryInterval   = flag.Duration("akka.retry-interval", 500*time.Millisecond, "Time to wait before retrying a failed fetch from Akka HTTP Endpoint.")
+		akkaKeepAlive       = flag.Duration("akka.tcp-keep-alive", 30*time.Second, "TCP keep-alive period for connections to Akka HTTP Endpoint.")
+		akkaMaxIdleConns    = flag.Int("akka.max-idle-conns", 2, "Maximum number of idle connections kept open to Akka HTTP Endpoint.")
+		akkaIdleTimeout     = flag.Duration("akka.idle-conn-timeout", 90*time.Second, "Time after which idle connections to Akka HTTP Endpoint are closed.")
+		akkaExcludeSelf     = flag.Bool("akka.exclude-self", false, "Leave the scraped node itself out of the member counts.")
+		akkaDropRemoved     = flag.Bool("akka.drop-removed", false, "Leave Removed members out of all member counts and metrics.")
+		akkaRoleMetrics     = flag.Bool("akka.role-metrics", false, "Export one akka_member_has_role series per member and role.")
+		akkaSanitizeNode    = flag.Bool("akka.sanitize-node-label", false, "Replace the separators in the node label of akka_member_has_role with underscores, keeping the raw address in an address label.")
+		akkaRequestBody     = flag.String("akka.request-body", "", "Body to POST to Akka HTTP Endpoint instead of a GET request, or @file to read it from a file on every scrape.")
+		akkaContentType     = flag.String("akka.request-content-type", "application/json", "Content type of -akka.request-body.")
+		akkaAuthToken       = flag.String("akka.auth-token", "", "Token sent to Akka HTTP Endpoint in the -akka.auth-header-name header.")
+		akkaAuthHeader      = flag.String("akka.auth-header-name", "Authorization", "Name of the header carrying -akka.auth-token.")
+		akkaAuthPrefix      = flag.String("akka.auth-header-prefix", "Bearer ", "Prefix put in front of -akka.auth-token in the auth header.")
+		akkaUsernameFile    = flag.String("akka.username-file", "", "File containing the basic auth username for Akka HTTP Endpoint, re-read on change.")
+		akkaPasswordFile    = flag.String("akka.password-file", "", "File containing the basic auth password for Akka HTTP Endpoint, re-read on change.")
+		akkaCollectTimeout  = flag.Duration("akka.collect-timeout", 0, "Maximum duration of a whole scrape including retries, 0 for no limit.")
+		akkaNormalize       = flag.Bool("akka.normalize-status", false, "Map differently spelled member statuses to the spelling used by Akka.")
+		akkaExpectedRoles   = flag.String("akka.expected-roles", "", "Comma separated list of roles the cluster members should hold.")
+		akkaFallbackDelay   = flag.Duration("akka.dial-fallback-delay", 300*time.Millisecond, "Delay before racing a connection over the other IP family to Akka HTTP Endpoint, negative to disable.")
+		akkaExpectedSize    = flag.String("akka.expected-size", "", "Number of members the cluster should have, e.g. ${REPLICAS} to read it from the environment.")
+		akkaBuckets         = flag.String("akka.scrape-duration-buckets", "0.01,0.025,0.05,0.1,0.25,0.5,1,2.5,5", "Comma separated buckets of the scrape duration histogram in seconds.")
+		akkaStatusLabel     = flag.String("akka.status-label-name", "status", "Name of the member status label, e.g. member_status if status clashes with a target label.")
+		akkaStatuses        = flag.String("akka.statuses", strings.Join(memberStatuses, ","), "Comma separated member statuses exported by the per-status metrics.")
+		akkaDNSCacheTTL     = flag.Duration("akka.dns-cache-ttl", 0, "Time to cache the resolved addresses of Akka HTTP Endpoint, 0 to resolve on every connection.")
+		akkaFailOnFirst     = flag.Bool("akka.fail-on-first-scrape", false, "Exit at startup if Akka HTTP Endpoint can't be scraped.")
+		akkaPollInterval    = flag.Duration("akka.poll-interval", 0, "Scrape Akka HTTP Endpoint in the background at this interval and serve the latest result, 0 to scrape on every collect.")
+		akkaErrorLogInt     = flag.Duration("akka.error-log-interval", 0, "Minimum time between logging identical scrape errors, 0 to log every error.")
+		akkaUpRequiresParse = flag.Bool("akka.up-requires-parse", false, "Only report akka_up as 1 when the response could be parsed as membership JSON.")
+		akkaStrictJSON      = flag.String("akka.strict-json", "", "Check responses for unknown fields and \"log\" them or \"fail\" the scrape, disabled if empty.")
+		akkaAnnotateHelp    = flag.Bool("akka.annotate-help", false, "Append the scraped URI to the help string of every cluster metric.")
+		akkaDomainEvents    = flag.String("akka.domain-events-uri", "", "URI of the Akka Management cluster domain events stream to follow instead of scraping, falling back to scraping while it's down.")
+		akkaJSONRoot        = flag.String("akka.json-root", "", "Dot separated path of the members object in responses wrapped in an envelope, e.g. data.cluster.")
+		akkaCBThreshold     = flag.Int("akka.circuit-breaker-threshold", 0, "Number of consecutive failed scrapes after which Akka HTTP Endpoint is not scraped for -akka.circuit-breaker-cooldown, 0 to disable.")
+		akkaCBCooldown      = flag.Duration("akka.circuit-breaker-cooldown", time.Minute, "Time Akka HTTP Endpoint is not scraped once the circuit breaker opened.")
+		akkaKeepLast        = flag.Bool("akka.keep-last-on-failure", false, "Keep exporting the member metrics of the last successful scrape when a scrape fails.")
+		check               = flag.Bool("check", false, "Scrape once, print a health report and exit with status 0 if the cluster is healthy, 1 if it isn't and 2 if it can't be scraped.")
+		checkRequireLeader  = flag.Bool("check.require-leader", true, "Let -check fail if the cluster has no leader.")
+		checkMaxUnreachable = flag.Int("check.max-unreachable", 0, "Maximum number of unreachable members -check accepts.")
+		listMetrics         = flag.Bool("list-metrics", false, "Print the name and help string of every exported metric and exit.")
+		listMetricsFormat   = flag.String("list-metrics.format", "text", "Output format of -list-metrics, \"text\" or \"json\".")
+		graphiteAddress     = flag.String("graphite.address", "", "Address of a Graphite plaintext listener to push metrics to, disabled if empty.")
+		graphiteInterval    = flag.Duration("graphite.interval", time.Minute, "Interval between pushes to Graphite.")
+		statsdAddress       = flag.String("statsd.address", "", "Address of a StatsD server to send metrics to over UDP, disabled if empty.")
+		statsdPrefix        = flag.String("statsd.prefix", "akka.", "Prefix of the metric names sent to StatsD.")
+		statsdInterval      = flag.Duration("statsd.interval", time.Minute, "Interval between sends to StatsD.")
+		textfileOutput      = flag.String("textfile.output", "", "File to write metrics to for the node_exporter textfile collector, disabled if empty.")
+		textfileInterval    = flag.Duration("textfile.interval", time.Minute, "Interval between writes of -textfile.output.")
+		pushGateway         = flag.String("push.gateway", "", "URL of a Pushgateway to push a single scrape to, used with -push.once.")
+		pushJob             = flag.String("push.job", "akka_cluster_http_management_exporter", "Job name used when pushing to the Pushgateway.")
+		pushOnce            = flag.Bool("push.once", false, "Scrape once, push the metrics to -push.gateway and exit.")
+		enableDiff          = flag.Bool("web.enable-diff", false, "Expose the membership changes between two scrapes on /diff.")
+		diffInterval        = flag.Duration("web.diff-interval", 5*time.Second, "Default time between the two scrapes compared on /diff.")
+		readTimeout         = flag.Duration("web.read-timeout", 10*time.Second, "Maximum duration for reading a request, including its body.")
+		writeTimeout        = flag.Duration("web.write-timeout", 2*time.Minute, "Maximum duration from the end of reading a request until its response is written, which must cover scraping Akka HTTP Endpoint.")
+		idleTimeout         = flag.Duration("web.idle-timeout", 2*time.Minute, "Maximum time to wait for the next request on a keep-alive connection.")
+		internalAddress     = flag.String("web.internal-listen-address", "", "Address to serve the exporter's own metrics on, leaving only cluster metrics on -web.listen-address.")
+		enableCompression   = flag.Bool("web.enable-compression", true, "Gzip the metrics response for clients accepting it.")
+		enableLastResponse  = flag.Bool("web.enable-last-response", false, "Expose the last response read from Akka HTTP Endpoint on /debug/last-response, whether or not it could be parsed.")
+		enableState         = flag.Bool("web.enable-state", false, "Expose the cluster state parsed from the last successful scrape as JSON on /state.")
+		enableConfig        = flag.Bool("web.enable-config", false, "Expose the effective configuration, with secrets redacted, on /config.")
+	)
+	flag.Var(&listenAddresses, "web.listen-address", "Address to listen on for web interface and telemetry, repeatable. (default \":9110\")")
+	flag.Var(&consensusURIs, "akka.consensus-uris", "URI of a node's Akka HTTP Endpoint whose view is merged with the others, repeatable. Replaces -akka.scrape-uri.")
+	flag.Var(&fieldMappings, "akka.field-mapping", "Rename a response field before parsing, as from=to, e.g. self_node=selfNode. Repeatable.")
+	flag.Parse()
+	if len(listenAddresses) == 0 {
+		listenAddresses = stringsFlag{":9110"}
+	}
+
+	if *showVersion {
+		fmt.Fprintln(os.Stdout, version.Print("akka_cluster_http_management_exporter"))
+		os.Exit(0)
+	}
+
+	log.Infoln("Starting akka_cluster_http_management_exporter", version.Info())
+	log.Infoln("Build context", version.BuildContext())
+
+	httpTransport := newTransport(*akkaKeepAlive, *akkaMaxIdleConns, *akkaIdleTimeout, *akkaFallbackDelay)
+	if *akkaDNSCacheTTL > 0 {
+		httpTransport.DialContext = newDNSCache(*akkaDNSCacheTTL, httpTransport.DialContext).DialContext
+	}
+	var transport http.RoundTripper = httpTransport
+	if *akkaUsernameFile != "" || *akkaPasswordFile != "" {
+		transport = &basicAuthRoundTripper{
+			usernameFile: *akkaUsernameFile,
+			passwordFile: *akkaPasswordFile,
+			next:         transport,
+		}
+	}
+	if *akkaAuthToken != "" {
+		transport = &headerRoundTripper{
+			name:  *akkaAuthHeader,
+			value: *akkaAuthPrefix + *akkaAuthToken,
+			next:  transport,
+		}
+	}
+	// The domain events stream is always requested with a GET.
+	scrapeTransport := transport
+	if *akkaRequestBody != "" {
+		rt := &bodyRoundTripper{contentType: *akkaContentType, next: transport}
+		if strings.HasPrefix(*akkaRequestBody, "@") {
+			rt.file = strings.TrimPrefix(*akkaRequestBody, "@")
+		} else {
+			rt.body = *akkaRequestBody
+		}
+		scrapeTransport = rt
+	}
+	scrapeURI, err := expandEnv(*akkaProxyScrapeURI)
+	if err != nil {
+		log.Fatal(err)
+	}
+	uris := make([]string, len(consensusURIs))
+	for i, uri := range consensusURIs {
+		if uris[i], err = expandEnv(uri); err != nil {
+			log.Fatal(err)
+		}
+	}
+	var exporter *Exporter
+	if len(uris) > 0 {
+		exporter, err = NewConsensusExporter(uris, *akkaProxyTimeout, scrapeTransport)
+	} else {
+		exporter, err = NewExporter(scrapeURI, *akkaProxyTimeout, scrapeTransport)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	buckets, err := parseBuckets(*akkaBuckets)
+	if err != nil {
+		log.Fatalf("invalid scrape duration buckets: %v", err)
+	}
+	exporter.SetScrapeDurationBuckets(buckets)
+	if !labelNameRE.MatchString(*akkaStatusLabel) {
+		log.Fatalf("invalid status label name: %q", *akkaStatusLabel)
+	}
+	exporter.SetStatusLabelName(*akkaStatusLabel)
+	if *akkaSanitizeNode {
+		exporter.SanitizeNodeLabel()
+	}
+	exporter.KeepLastOnFailure = *akkaKeepLast
+	exporter.JSONRoot = *akkaJSONRoot
+	if len(fieldMappings) > 0 {
+		exporter.FieldMapping = make(map[string]string, len(fieldMappings))
+		for _, mapping := range fieldMappings {
+			parts := strings.SplitN(mapping, "=", 2)
+			if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+				log.Fatalf("invalid field mapping: %q", mapping)
+			}
+			exporter.FieldMapping[parts[0]] = parts[1]
+		}
+	}
+	if *akkaDomainEvents != "" {
+		exporter.FollowDomainEvents(*akkaDomainEvents, transport)
+	}
+	switch *akkaStrictJSON {
+	case "", "log", "fail":
+		exporter.StrictJSON = *akkaStrictJSON
+	default:
+		log.Fatalf("unsupported strict JSON mode: %q", *akkaStrictJSON)
+	}
+	exporter.UpRequiresParse = *akkaUpRequiresParse
+	exporter.ExcludeSelf = *akkaExcludeSelf
+	exporter.DropRemoved = *akkaDropRemoved
+	exporter.RoleMetrics = *akkaRoleMetrics
+	exporter.NormalizeStatus = *akkaNormalize
+	if exporter.Statuses, err = parseStatuses(*akkaStatuses); err != nil {
+		log.Fatalf("invalid statuses: %v", err)
+	}
+	if *akkaExpectedSize != "" {
+		size, err := expandEnv(*akkaExpectedSize)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if exporter.ExpectedSize, err = strconv.Atoi(size); err != nil || exporter.ExpectedSize < 1 {
+			log.Fatalf("invalid expected cluster size: %q", size)
+		}
+	}
+	if *akkaExpectedRoles != "" {
+		if exporter.ExpectedRoles, err = parseRoles(*akkaExpectedRoles); err != nil {
+			log.Fatalf("invalid expected roles: %v", err)
+		}
+	}
+	exporter.Retries = *akkaRetries
+	exporter.CollectTimeout = *akkaCollectTimeout
+	exporter.RetryInterval = *akkaRetryInterval
+	exporter.ErrorLogInterval = *akkaErrorLogInt
+	exporter.CircuitBreakerThreshold = *akkaCBThreshold
+	exporter.CircuitBreakerCooldown = *akkaCBCooldown
+	switch *akkaTransitions {
+	case "counter":
+	case "gauge":
+		exporter.TransitionsAsGauge = true
+	default:
+		log.Fatalf("unsupported transitions metric type: %q", *akkaTransitions)
+	}
+	versionCollector := version.NewCollector("akka_cluster_http_management_exporter")
+
+	if *listMetrics {
+		infos, err := describeMetrics(exporter, versionCollector)
+		if err != nil {
+			log.Fatal(err)
+		}
+		switch *listMetricsFormat {
+		case "text":
+			for _, info := range infos {
+				fmt.Fprintf(os.Stdout, "%s %s\n", info.Name, info.Help)
+			}
+		case "json":
+			json.NewEncoder(os.Stdout).Encode(infos)
+		default:
+			log.Fatalf("unsupported metrics list format: %q", *listMetricsFormat)
+		}
+		os.Exit(0)
+	}
+
+	if *check {
+		ctx, cancel := context.WithTimeout(context.Background(), *akkaProxyTimeout)
+		m, err := exporter.fetchCluster(ctx)
+		cancel()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Can't scrape akka http management endpoint: %v\n", err)
+			os.Exit(2)
+		}
+		healthCheck := healthCheck{
+			RequireLeader:  *checkRequireLeader,
+			MaxUnreachable: *checkMaxUnreachable,
+			MinMembers:     exporter.ExpectedSize,
+		}
+		if !healthCheck.report(os.Stdout, m) {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if *akkaFailOnFirst {
+		ctx, cancel := context.WithTimeout(context.Background(), *akkaProxyTimeout)
+		_, err := exporter.fetchCluster(ctx)
+		cancel()
+		if err != nil {
+			log.Fatalf("Can't scrape akka http management endpoint: %v", err)
+		}
+	}
+
+	var collector prometheus.Collector = exporter
+	if *akkaAnnotateHelp {
+		collector = newHelpAnnotator(exporter, fmt.Sprintf(" (source: %s)", redactURI(exporter.URI)))
+	}
+	prometheus.MustRegister(collector)
+	if *internalAddress != "" {
+		// The exporter's own metrics are served separately, leaving only the
+		// cluster metrics on the main listeners.
+		exporter.SeparateScrapeStats = true
+		prometheus.Unregister(prometheus.NewGoCollector())
+		prometheus.Unregister(prometheus.NewProcessCollector(os.Getpid(), ""))
+	} else {
+		prometheus.MustRegister(versionCollector)
+	}
+
+	if *pushOnce || *pushGateway != "" {
+		if !*pushOnce || *pushGateway == "" {
+			log.Fatal("-push.once and -push.gateway must be used together")
+		}
+		if err := prometheus.Push(*pushJob, "", *pushGateway); err != nil {
+			log.Fatalf("Can't push metrics to %s: %v", *pushGateway, err)
+		}
+		log.Infoln("Pushed metrics to", *pushGateway)
+		os.Exit(0)
+	}
+
+	if *akkaPollInterval > 0 {
+		log.Infoln("Polling akka http management endpoint every", *akkaPollInterval)
+		go exporter.Poll(*akkaPollInterval)
+	}
+	if *graphiteAddress != "" {
+		log.Infoln("Pushing metrics to graphite at", *graphiteAddress)
+		go pushGraphite(*graphiteAddress, *graphiteInterval, collector)
+	}
+	if *textfileOutput != "" {
+		log.Infoln("Writing metrics to", *textfileOutput)
+		go writeTextfile(*textfileOutput, *textfileInterval, collector, versionCollector)
+	}
+	if *statsdAddress != "" {
+		log.Infoln("Sending metrics to statsd at", *statsdAddress)
+		go pushStatsD(*statsdAddress, *statsdPrefix, *statsdInterval, collector)
+	}
+
+	log.Infoln("Listening on", listenAddresses)
+	var metricsHandler http.Handler
+	if *internalAddress != "" {
+		metricsHandler = prometheus.UninstrumentedHandler()
+	} else {
+		metricsHandler = prometheus.Handler()
+	}
+	if !*enableCompression {
+		metricsHandler = withoutCompression(metricsHandler)
+	}
+	http.Handle(*metricsPath, metricsHandler)
+	if *enableDiff {
+		http.HandleFunc("/diff", func(w http.ResponseWriter, r *http.Request) {
+			serveDiff(w, r, exporter, *diffInterval)
+		})
+	}
+	if *enableLastResponse {
+		http.HandleFunc("/debug/last-response", func(w http.ResponseWriter, r *http.Request) {
+			b := exporter.LastResponse()
+			if b == nil {
+				http.Error(w, "no response read yet", http.StatusNotFound)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(b)
+		})
+	}
+	if *enableState {
+		http.HandleFunc("/state", func(w http.ResponseWriter, r *http.Request) {
+			state := exporter.State()
+			if state == nil {
+				http.Error(w, "no successful scrape yet", http.StatusNotFound)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			enc := json.NewEncoder(w)
+			enc.SetEscapeHTML(false)
+			enc.Encode(state)
+		})
+	}
+	if *enableConfig {
+		config := effectiveConfig{
+			Timeout:               akkaProxyTimeout.String(),
+			Auth:                  *akkaAuthToken != "" || *akkaUsernameFile != "" || *akkaPasswordFile != "",
+			TransitionsMetricType: *akkaTransitions,
+			KeepLastOnFailure:     *akkaKeepLast,
+			JSONRoot:              *akkaJSONRoot,
+			UpRequiresParse:       *akkaUpRequiresParse,
+			ExcludeSelf:           *akkaExcludeSelf,
+			DropRemoved:           *akkaDropRemoved,
+			RoleMetrics:           *akkaRoleMetrics,
+			NormalizeStatus:       *akkaNormalize,
+			Statuses:              *akkaStatuses,
+			ExpectedRoles:         *akkaExpectedRoles,
+			ExpectedSize:          exporter.ExpectedSize,
+			Retries:               *akkaRetries,
+			RetryInterval:         akkaRetryInterval.String(),
+			CollectTimeout:        akkaCollectTimeout.String(),
+			PollInterval:          akkaPollInterval.String(),
+		}
+		targets := uris
+		if len(uris) > 0 {
+			for _, uri := range uris {
+				config.ConsensusURIs = append(config.ConsensusURIs, redactURI(uri))
+			}
+		} else {
+			config.ScrapeURI = redactURI(scrapeURI)
+			targets = []string{scrapeURI}
+		}
+		for _, uri := range targets {
+			u, _ := url.Parse(uri)
+			config.TLS = config.TLS || u.Scheme == "https"
+			config.Auth = config.Auth || u.User != nil
+		}
+		http.HandleFunc("/config", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			enc := json.NewEncoder(w)
+			enc.SetEscapeHTML(false)
+			enc.Encode(config)
+		})
+	}
+	http.HandleFunc("/version", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(versionInfo{
+			Version:   version.Version,
+			Revision:  version.Revision,
+			Branch:    version.Branch,
+			BuildUser: version.BuildUser,
+			BuildDate: version.BuildDate,
+			GoVersion: version.GoVersion,
+		})
+	})
+	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`<html>
+             <head><title>Akka Cluster HTTP Management Exporter</title></head>
+             <body>
+             <h1>Akka Cluster HTTP Management Exporter</h1>
+             <p><a href='` + *metricsPath + `'>Metrics</a></p>
+             </body>
+             </html>`))
+	})
+	handlers := make(map[string]http.Handler)
+	for _, address := range listenAddresses {
+		handlers[address] = http.DefaultServeMux
+	}
+	if *internalAddress != "" {
+		if _, ok := handlers[*internalAddress]; ok {
+			log.Fatalf("-web.internal-listen-address %s is also a -web.listen-address", *internalAddress)
+		}
+		log.Infoln("Serving exporter metrics on", *internalAddress)
+		internal := http.NewServeMux()
+		internal.Handle(*metricsPath, collectorHandler(
+			prometheus.NewGoCollector(),
+			prometheus.NewProcessCollector(os.Getpid(), ""),
+			versionCollector,
+			exporter.ScrapeStats(),
+		))
+		handlers[*internalAddress] = internal
+	}
+	if err := listenAndServe(handlers, *readTimeout, *writeTimeout, *idleTimeout); err != nil {
+		log.Fatal(err)
+	}
 }
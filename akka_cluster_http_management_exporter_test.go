@@ -0,0 +1,677 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+)
+
+func readFixture(t *testing.T, name string) []byte {
+	b, err := ioutil.ReadFile("test/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// metricValues collects c and returns the values of its gauges and counters
+// by series, e.g. akka_current_members{status="Up"}.
+func metricValues(t *testing.T, c prometheus.Collector) map[string]float64 {
+	families, err := gatherFamilies(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := make(map[string]float64)
+	for _, mf := range families {
+		for _, m := range mf.GetMetric() {
+			series := mf.GetName()
+			if len(m.GetLabel()) > 0 {
+				labels := make([]string, len(m.GetLabel()))
+				for i, l := range m.GetLabel() {
+					labels[i] = fmt.Sprintf("%s=%q", l.GetName(), l.GetValue())
+				}
+				series += "{" + strings.Join(labels, ",") + "}"
+			}
+			switch {
+			case m.Gauge != nil:
+				values[series] = m.Gauge.GetValue()
+			case m.Counter != nil:
+				values[series] = m.Counter.GetValue()
+			}
+		}
+	}
+	return values
+}
+
+func TestExporterFromJSON(t *testing.T) {
+	e, err := ExporterFromJSON(readFixture(t, "akka-cluster-members-unreachable.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := metricValues(t, e)
+	for series, expected := range map[string]float64{
+		"akka_up":                                  1,
+		`akka_current_members{status="Up"}`:        3,
+		`akka_current_members{status="Leaving"}`:   1,
+		`akka_current_members{status="Down"}`:      0,
+		`akka_members_status_ratio{status="Up"}`:   0.75,
+		"akka_has_leader":                          1,
+		"akka_self_node_present":                   1,
+		"akka_self_is_oldest":                      1,
+		"akka_members_departing":                   1,
+		"akka_unreachable_observers_total":         3,
+		`akka_unreachable_by_role{role="backend"}`: 2,
+	} {
+		if values[series] != expected {
+			t.Errorf("%s: expected %g, got %g", series, expected, values[series])
+		}
+	}
+}
+
+func TestExpectationsIncludeSelf(t *testing.T) {
+	e, err := ExporterFromJSON(readFixture(t, "akka-cluster-members-unreachable.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The self node is the only one holding frontend.
+	e.ExcludeSelf = true
+	e.ExpectedSize = 4
+	e.ExpectedRoles = []string{"frontend", "backend"}
+	values := metricValues(t, e)
+	for series, expected := range map[string]float64{
+		`akka_current_members{status="Up"}`: 2,
+		"akka_members_vs_expected":          0,
+		"akka_missing_roles":                0,
+		"akka_unexpected_roles":             0,
+	} {
+		if values[series] != expected {
+			t.Errorf("%s: expected %g, got %g", series, expected, values[series])
+		}
+	}
+}
+
+// The Exporter is a plain prometheus.Collector, so it can be registered next
+// to an application's own collectors. Exporters don't share any metrics, so
+// collecting another one leaves the series of the first alone.
+func ExampleExporter() {
+	b, err := ioutil.ReadFile("test/akka-cluster-members.json")
+	if err != nil {
+		log.Fatal(err)
+	}
+	exporter, err := ExporterFromJSON(b)
+	if err != nil {
+		log.Fatal(err)
+	}
+	jobs := prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "myapp_jobs_processed_total",
+		Help: "Number of jobs processed.",
+	})
+	jobs.Add(42)
+	prometheus.MustRegister(exporter)
+	prometheus.MustRegister(jobs)
+	defer prometheus.Unregister(exporter)
+	defer prometheus.Unregister(jobs)
+
+	if b, err = ioutil.ReadFile("test/akka-cluster-members-unreachable.json"); err != nil {
+		log.Fatal(err)
+	}
+	other, err := ExporterFromJSON(b)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if _, err := gatherFamilies(other); err != nil {
+		log.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	prometheus.UninstrumentedHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	for _, line := range strings.Split(rec.Body.String(), "\n") {
+		if strings.HasPrefix(line, `akka_current_members{status="Up"}`) || strings.HasPrefix(line, "myapp_") {
+			fmt.Println(line)
+		}
+	}
+	// Output:
+	// akka_current_members{status="Up"} 3
+	// myapp_jobs_processed_total 42
+}
+
+func TestExporterFromJSONInvalid(t *testing.T) {
+	if _, err := ExporterFromJSON([]byte("not json")); err == nil {
+		t.Error("expected error for a payload that isn't membership JSON")
+	}
+}
+
+func TestParseNodeAddress(t *testing.T) {
+	for _, tc := range []struct {
+		node               string
+		system, host, port string
+		err                bool
+	}{
+		{node: "akka.tcp://AccountService@trading-account-1:2551", system: "AccountService", host: "trading-account-1", port: "2551"},
+		{node: "akka://AccountService@10.0.0.1:25520", system: "AccountService", host: "10.0.0.1", port: "25520"},
+		{node: "akka.tcp://AccountService@[fd00::1]:2551", system: "AccountService", host: "fd00::1", port: "2551"},
+		{node: "akka://AccountService@[::1]:2552", system: "AccountService", host: "::1", port: "2552"},
+		// Without brackets, the port can't be told apart from the address.
+		{node: "akka://AccountService@fd00::1:2551", err: true},
+		{node: "akka://trading-account-1:2551", err: true},
+		{node: "akka://AccountService@trading-account-1", err: true},
+		{node: "trading-account-1:2551", err: true},
+		{node: "", err: true},
+	} {
+		system, host, port, err := parseNodeAddress(tc.node)
+		if tc.err {
+			if err == nil {
+				t.Errorf("%q: expected error, got %q, %q, %q", tc.node, system, host, port)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", tc.node, err)
+			continue
+		}
+		if system != tc.system || host != tc.host || port != tc.port {
+			t.Errorf("%q: expected %q, %q, %q, got %q, %q, %q", tc.node, tc.system, tc.host, tc.port, system, host, port)
+		}
+	}
+}
+
+func TestParseNodeAddressIPv6Members(t *testing.T) {
+	m, err := parseCluster(readFixture(t, "akka-cluster-members-ipv6.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"fd00::1", "fd00::2", "::1"}
+	if len(m.Members) != len(expected) {
+		t.Fatalf("expected %d members, got %d", len(expected), len(m.Members))
+	}
+	for i, n := range m.Members {
+		_, host, _, err := parseNodeAddress(n.Node)
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", n.Node, err)
+		} else if host != expected[i] {
+			t.Errorf("%q: expected host %q, got %q", n.Node, expected[i], host)
+		}
+	}
+}
+
+func TestParseClusterShapes(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		payload  []byte
+		selfNode string
+		members  int
+		err      string
+	}{
+		{
+			name:     "members",
+			payload:  readFixture(t, "akka-cluster-members.json"),
+			selfNode: "akka.tcp://AccountService@trading-account-3:2551",
+			members:  3,
+		},
+		{
+			name:     "cluster members",
+			payload:  readFixture(t, "akka-cluster-members-wrapped.json"),
+			selfNode: "akka.tcp://AccountService@trading-account-3:2551",
+			members:  3,
+		},
+		{
+			name:    "neither",
+			payload: []byte(`{"status": "ok", "nodes": []}`),
+			err:     "unrecognized membership response: no members field found",
+		},
+		{
+			name:    "ambiguous",
+			payload: []byte(`{"b": {"members": []}, "a": {"members": []}}`),
+			err:     "ambiguous membership response: members field found in a, b",
+		},
+	} {
+		m, err := parseCluster(tc.payload)
+		if tc.err != "" {
+			if err == nil || err.Error() != tc.err {
+				t.Errorf("%s: expected error %q, got %v", tc.name, tc.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.name, err)
+			continue
+		}
+		if m.SelfNode != tc.selfNode || len(m.Members) != tc.members {
+			t.Errorf("%s: expected self node %q and %d members, got %q and %d", tc.name, tc.selfNode, tc.members, m.SelfNode, len(m.Members))
+		}
+	}
+}
+
+func TestParseStatuses(t *testing.T) {
+	for _, tc := range []struct {
+		in       string
+		expected []string
+		err      bool
+	}{
+		{in: "Up", expected: []string{"Up"}},
+		{in: "Up, Down ,WeaklyUp", expected: []string{"Up", "Down", "WeaklyUp"}},
+		{in: "", err: true},
+		{in: "Up,", err: true},
+		{in: "Up,up", err: true},
+		{in: "Up,Unknown", err: true},
+	} {
+		statuses, err := parseStatuses(tc.in)
+		if tc.err {
+			if err == nil {
+				t.Errorf("%q: expected error, got %q", tc.in, statuses)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", tc.in, err)
+			continue
+		}
+		if strings.Join(statuses, ",") != strings.Join(tc.expected, ",") {
+			t.Errorf("%q: expected %q, got %q", tc.in, tc.expected, statuses)
+		}
+	}
+}
+
+func TestParseRoles(t *testing.T) {
+	for _, tc := range []struct {
+		in       string
+		expected []string
+		err      bool
+	}{
+		{in: "frontend", expected: []string{"frontend"}},
+		{in: "frontend, backend", expected: []string{"frontend", "backend"}},
+		{in: "", err: true},
+		{in: "frontend,", err: true},
+		{in: "frontend, ,backend", err: true},
+	} {
+		roles, err := parseRoles(tc.in)
+		if tc.err {
+			if err == nil {
+				t.Errorf("%q: expected error, got %q", tc.in, roles)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", tc.in, err)
+			continue
+		}
+		if strings.Join(roles, ",") != strings.Join(tc.expected, ",") {
+			t.Errorf("%q: expected %q, got %q", tc.in, tc.expected, roles)
+		}
+	}
+}
+
+func TestFixtureMetrics(t *testing.T) {
+	for _, tc := range []struct {
+		fixture  string
+		expected map[string]float64
+	}{
+		{
+			// trading-account-3 is Up and unreachable, trading-account-4
+			// is unreachable while Leaving.
+			fixture: "akka-cluster-members-unreachable.json",
+			expected: map[string]float64{
+				"akka_up_but_unreachable": 1,
+			},
+		},
+		{
+			// Observed by 1 of the 4 reachable members.
+			fixture: "akka-cluster-members-unreachable-minority.json",
+			expected: map[string]float64{
+				"akka_minority_unreachable": 1,
+			},
+		},
+		{
+			fixture: "akka-cluster-members-unreachable-orphan.json",
+			expected: map[string]float64{
+				"akka_unreachable_not_in_members": 1,
+			},
+		},
+		{
+			fixture: "akka-cluster-members-typed.json",
+			expected: map[string]float64{
+				`akka_current_members{status="Up"}`:                2,
+				`akka_current_members{status="WeaklyUp"}`:          1,
+				`akka_members_by_system{system="AccountService"}`:  3,
+				`akka_members_by_host{host="10.0.0.3"}`:            1,
+				`akka_response_field_present{field="unreachable"}`: 1,
+				"akka_datacenter_count":                            1,
+				"akka_has_leader":                                  1,
+				"akka_self_node_present":                           1,
+				"akka_self_is_oldest":                              0,
+				"akka_avg_roles_per_member":                        2.0 / 3,
+			},
+		},
+		{
+			// A member without an app version isn't counted as skewed.
+			fixture: "akka-cluster-members-app-version.json",
+			expected: map[string]float64{
+				"akka_members_app_version_skew": 1,
+			},
+		},
+	} {
+		e, err := ExporterFromJSON(readFixture(t, tc.fixture))
+		if err != nil {
+			t.Errorf("%s: %v", tc.fixture, err)
+			continue
+		}
+		values := metricValues(t, e)
+		for series, expected := range tc.expected {
+			if value, ok := values[series]; !ok {
+				t.Errorf("%s: %s not exported", tc.fixture, series)
+			} else if value != expected {
+				t.Errorf("%s: %s: expected %g, got %g", tc.fixture, series, expected, value)
+			}
+		}
+	}
+}
+
+func TestTrimJSON(t *testing.T) {
+	for in, expected := range map[string]string{
+		`{"members": []}`:               `{"members": []}`,
+		"\xef\xbb\xbf{\"members\": []}": `{"members": []}`,
+		" \n\xef\xbb\xbf{}\r\n":         `{}`,
+		"\t{}\n":                        `{}`,
+	} {
+		if got := string(trimJSON([]byte(in))); got != expected {
+			t.Errorf("%q: expected %q, got %q", in, expected, got)
+		}
+	}
+}
+
+func TestParseClusterBOM(t *testing.T) {
+	b := readFixture(t, "akka-cluster-members-bom.json")
+	if !strings.HasPrefix(string(b), "\xef\xbb\xbf") {
+		t.Fatal("fixture lacks a byte order mark")
+	}
+	m, err := parseCluster(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Members) != 3 {
+		t.Errorf("expected 3 members, got %d", len(m.Members))
+	}
+}
+
+// payloadExporter returns an Exporter reading *payload on every collect, so
+// tests can change the response between scrapes.
+func payloadExporter(payload *[]byte) *Exporter {
+	return newExporter("", func(ctx context.Context) (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(*payload)), nil
+	})
+}
+
+func TestUnreachableDurationSurvivesParseError(t *testing.T) {
+	fixture := readFixture(t, "akka-cluster-members-unreachable.json")
+	payload := fixture
+	e := payloadExporter(&payload)
+	metricValues(t, e)
+
+	// Backdate the first scrape rather than waiting.
+	node := "akka.tcp://AccountService@trading-account-3:2551"
+	e.unreachableSince[node] = time.Now().Add(-time.Minute)
+	payload = []byte("not json")
+	if values := metricValues(t, e); values["akka_scrape_parse_errors_total"] != 1 {
+		t.Fatalf("expected a parse error, got %g", values["akka_scrape_parse_errors_total"])
+	}
+	payload = fixture
+	values := metricValues(t, e)
+	series := fmt.Sprintf("akka_unreachable_duration_seconds{node=%q}", node)
+	if values[series] < 60 {
+		t.Errorf("%s: expected at least 60, got %g", series, values[series])
+	}
+	if values["akka_max_unreachable_duration_seconds"] < 60 {
+		t.Errorf("akka_max_unreachable_duration_seconds: expected at least 60, got %g", values["akka_max_unreachable_duration_seconds"])
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	for _, tc := range []struct {
+		err       error
+		retryable bool
+	}{
+		{err: statusError(503), retryable: true},
+		{err: statusError(429), retryable: true},
+		{err: statusError(404), retryable: false},
+		{err: &url.Error{Op: "Get", URL: "http://localhost:19999/members", Err: &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}}, retryable: true},
+		{err: &url.Error{Op: "Get", URL: "http://localhost:19999/members", Err: io.EOF}, retryable: true},
+		{err: &url.Error{Op: "Get", URL: "http://localhost:19999/members", Err: errors.New("x509: certificate signed by unknown authority")}, retryable: false},
+		{err: fmt.Errorf("none of the 2 endpoints could be scraped: %w", context.DeadlineExceeded), retryable: true},
+		{err: &os.PathError{Op: "open", Path: "test/missing.json", Err: syscall.ENOENT}, retryable: false},
+		{err: errors.New("no field data in response"), retryable: false},
+	} {
+		if retryable(tc.err) != tc.retryable {
+			t.Errorf("%v: expected retryable %t", tc.err, tc.retryable)
+		}
+	}
+}
+
+func TestMembershipChangeSurvivesFailedScrapes(t *testing.T) {
+	fixture := readFixture(t, "akka-cluster-members.json")
+	payload := fixture
+	e := payloadExporter(&payload)
+	metricValues(t, e)
+
+	e.membershipChangedAt = time.Now().Add(-time.Minute)
+	for _, payload = range [][]byte{[]byte("not json"), []byte(""), fixture} {
+		metricValues(t, e)
+	}
+	values := metricValues(t, e)
+	if values["akka_seconds_since_membership_change"] < 60 {
+		t.Errorf("expected at least 60 seconds since the last change, got %g", values["akka_seconds_since_membership_change"])
+	}
+
+	payload = bytes.Replace(fixture, []byte(`"Up"`), []byte(`"Leaving"`), 1)
+	values = metricValues(t, e)
+	if values["akka_seconds_since_membership_change"] >= 60 {
+		t.Errorf("expected a status change to reset the time since the last change, got %g", values["akka_seconds_since_membership_change"])
+	}
+}
+
+func TestMergeClusters(t *testing.T) {
+	a := Cluster{
+		SelfNode: "akka://Sys@node-1:2552",
+		Leader:   "akka://Sys@node-1:2552",
+		Members: []ClusterNode{
+			{Node: "akka://Sys@node-1:2552", NodeUid: "1", Status: "Up"},
+			{Node: "akka://Sys@node-2:2552", NodeUid: "2", Status: "Up"},
+			{Node: "akka://Sys@node-3:2552", NodeUid: "3", Status: "Joining"},
+		},
+		Unreachable: []ClusterNode{
+			{Node: "akka://Sys@node-2:2552", ObservedBy: []string{"akka://Sys@node-1:2552"}},
+		},
+	}
+	b := Cluster{
+		SelfNode: "akka://Sys@node-2:2552",
+		Leader:   "akka://Sys@node-2:2552",
+		Members: []ClusterNode{
+			{Node: "akka://Sys@node-1:2552", NodeUid: "1", Status: "Up"},
+			// Gossip only moves members forward, so Leaving wins.
+			{Node: "akka://Sys@node-2:2552", NodeUid: "2", Status: "Leaving"},
+			{Node: "akka://Sys@node-3:2552", NodeUid: "3", Status: "WeaklyUp"},
+			// A new incarnation under the same address is another member.
+			{Node: "akka://Sys@node-1:2552", NodeUid: "4", Status: "Joining"},
+		},
+		Unreachable: []ClusterNode{
+			{Node: "akka://Sys@node-2:2552", ObservedBy: []string{"akka://Sys@node-1:2552", "akka://Sys@node-3:2552"}},
+		},
+	}
+
+	m, disagreements := mergeClusters([]Cluster{a, b})
+	if disagreements != 2 {
+		t.Errorf("expected 2 disagreements, got %d", disagreements)
+	}
+	if m.SelfNode != a.SelfNode || m.Leader != a.Leader {
+		t.Errorf("expected the self node and leader of the first view, got %q and %q", m.SelfNode, m.Leader)
+	}
+	var statuses []string
+	for _, n := range m.Members {
+		statuses = append(statuses, n.NodeUid+":"+n.Status)
+	}
+	if got, expected := strings.Join(statuses, ","), "1:Up,2:Leaving,3:WeaklyUp,4:Joining"; got != expected {
+		t.Errorf("expected members %s, got %s", expected, got)
+	}
+	if len(m.Unreachable) != 1 {
+		t.Fatalf("expected 1 unreachable node, got %d", len(m.Unreachable))
+	}
+	if got := strings.Join(m.Unreachable[0].ObservedBy, ","); got != "akka://Sys@node-1:2552,akka://Sys@node-3:2552" {
+		t.Errorf("expected the observers of both views, got %s", got)
+	}
+}
+
+func TestFetchConsensus(t *testing.T) {
+	e := newExporter("", nil)
+	e.NormalizeStatus = true
+	views := [][]byte{
+		[]byte(`{"members": [{"node": "akka://Sys@node-1:2552", "nodeUid": "1", "status": "weaklyup"}]}`),
+		[]byte(`{"members": [{"node": "akka://Sys@node-1:2552", "nodeUid": "1", "status": "Joining"}]}`),
+	}
+	fetches := []func(ctx context.Context) (io.ReadCloser, error){
+		func(ctx context.Context) (io.ReadCloser, error) {
+			return ioutil.NopCloser(bytes.NewReader(views[0])), nil
+		},
+		func(ctx context.Context) (io.ReadCloser, error) {
+			return ioutil.NopCloser(bytes.NewReader(views[1])), nil
+		},
+		func(ctx context.Context) (io.ReadCloser, error) {
+			return nil, statusError(503)
+		},
+	}
+	m, err := readCluster(context.Background(), e.fetchConsensus([]string{"a", "b", "c"}, fetches))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// weaklyup only ranks above Joining once normalized.
+	if len(m.Members) != 1 || m.Members[0].Status != "WeaklyUp" {
+		t.Errorf("expected a single WeaklyUp member, got %+v", m.Members)
+	}
+
+	_, err = readCluster(context.Background(), e.fetchConsensus([]string{"c"}, fetches[2:]))
+	if err == nil {
+		t.Fatal("expected an error when no endpoint could be scraped")
+	}
+	if !retryable(err) {
+		t.Errorf("expected the endpoint's error to be wrapped, got %v", err)
+	}
+}
+
+func TestUnparseableResponsesAreNotSuccesses(t *testing.T) {
+	fixture := readFixture(t, "akka-cluster-members.json")
+	payload := fixture
+	e := payloadExporter(&payload)
+	e.KeepLastOnFailure = true
+	metricValues(t, e)
+
+	payload = []byte("<html>Bad Gateway</html>")
+	var values map[string]float64
+	for i := 0; i < 3; i++ {
+		values = metricValues(t, e)
+	}
+	if values["akka_scrapes_since_last_success"] != 3 {
+		t.Errorf("expected 3 scrapes since the last success, got %g", values["akka_scrapes_since_last_success"])
+	}
+	if values[`akka_current_members{status="Up"}`] != 3 {
+		t.Errorf("expected the last members to be kept, got %g", values[`akka_current_members{status="Up"}`])
+	}
+
+	payload = fixture
+	if values = metricValues(t, e); values["akka_scrapes_since_last_success"] != 0 {
+		t.Errorf("expected a successful scrape to reset the count, got %g", values["akka_scrapes_since_last_success"])
+	}
+}
+
+func TestStreamDomainEvents(t *testing.T) {
+	events := readFixture(t, "akka-cluster-domain-events.txt")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write(events)
+	}))
+	defer server.Close()
+
+	view := &domainEventView{}
+	if err := streamDomainEvents(server.Client(), server.URL, view); err != io.EOF {
+		t.Fatalf("expected the stream to end, got %v", err)
+	}
+	b, ok := view.snapshot()
+	if !ok {
+		t.Fatal("expected a snapshot")
+	}
+	m, err := parseCluster(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Leader != "akka://AccountService@10.0.0.1:25520" {
+		t.Errorf("expected the leader of the stream, got %q", m.Leader)
+	}
+	statuses := statusesByNode(m.Members)
+	for node, expected := range map[string]string{
+		"akka://AccountService@10.0.0.1:25520": "Leaving",
+		"akka://AccountService@10.0.0.2:25520": "Up",
+		"akka://AccountService@10.0.0.3:25520": "Up",
+	} {
+		if statuses[node] != expected {
+			t.Errorf("%s: expected %s, got %q", node, expected, statuses[node])
+		}
+	}
+	if len(m.Unreachable) != 1 || m.Unreachable[0].Node != "akka://AccountService@10.0.0.2:25520" {
+		t.Errorf("expected 10.0.0.2 to be unreachable, got %+v", m.Unreachable)
+	}
+
+	// The stream has no self node, oldest member or observers, so the
+	// gauges derived from them are left out.
+	e := newExporter("", func(ctx context.Context) (io.ReadCloser, error) {
+		return domainEventSnapshot{bytes.NewReader(b)}, nil
+	})
+	values := metricValues(t, e)
+	if values[`akka_current_members{status="Up"}`] != 2 {
+		t.Errorf("expected 2 Up members, got %g", values[`akka_current_members{status="Up"}`])
+	}
+	for _, name := range []string{"akka_self_node_present", "akka_self_is_oldest", "akka_minority_unreachable", "akka_unreachable_observers_total", "akka_members_app_version_skew"} {
+		if _, ok := values[name]; ok {
+			t.Errorf("%s: expected no value for a view from the domain events stream", name)
+		}
+	}
+}
+
+func TestRestartsForgetOldAddresses(t *testing.T) {
+	fixture := readFixture(t, "akka-cluster-members.json")
+	payload := fixture
+	e := payloadExporter(&payload)
+	metricValues(t, e)
+
+	// A node gone for a while is forgotten, one gone briefly isn't.
+	gone, recent := "akka.tcp://AccountService@10.0.0.9:2551", "akka.tcp://AccountService@10.0.0.8:2551"
+	e.uids[gone], e.uidsSeen[gone] = "1", time.Now().Add(-2*uidRetention)
+	e.uids[recent], e.uidsSeen[recent] = "2", time.Now().Add(-time.Minute)
+	metricValues(t, e)
+	if _, ok := e.uids[gone]; ok {
+		t.Errorf("expected the UID of %s to be forgotten", gone)
+	}
+	if _, ok := e.uids[recent]; !ok {
+		t.Errorf("expected the UID of %s to be kept", recent)
+	}
+	if len(e.uids) != 4 {
+		t.Errorf("expected the UIDs of the 3 members and %s, got %v", recent, e.uids)
+	}
+
+	payload = bytes.Replace(fixture, []byte(`"1107177422"`), []byte(`"42"`), 1)
+	values := metricValues(t, e)
+	if series := `akka_member_restarts_total{node="akka.tcp://AccountService@trading-account-1:2551"}`; values[series] != 1 {
+		t.Errorf("%s: expected 1, got %g", series, values[series])
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+)
+
+// healthCheck is the predicate evaluated by -check: a cluster is healthy if
+// it has a leader (unless not required), at most MaxUnreachable unreachable
+// members and at least MinMembers members.
+type healthCheck struct {
+	RequireLeader  bool
+	MaxUnreachable int
+	MinMembers     int
+}
+
+// report writes one line per condition of the check to w and returns whether
+// all of them hold.
+func (c healthCheck) report(w io.Writer, m Cluster) bool {
+	healthy := true
+	line := func(ok bool, format string, args ...interface{}) {
+		result := "ok"
+		if !ok {
+			result = "FAIL"
+			healthy = false
+		}
+		fmt.Fprintf(w, "%-4s  %s\n", result, fmt.Sprintf(format, args...))
+	}
+
+	if c.RequireLeader {
+		if m.Leader != "" {
+			line(true, "leader: %s", m.Leader)
+		} else {
+			line(false, "leader: none")
+		}
+	}
+	line(len(m.Unreachable) <= c.MaxUnreachable, "unreachable: %d (at most %d)", len(m.Unreachable), c.MaxUnreachable)
+	for _, n := range m.Unreachable {
+		fmt.Fprintf(w, "      %s observed by %d\n", n.Node, len(n.ObservedBy))
+	}
+	line(len(m.Members) >= c.MinMembers, "members: %d (at least %d)", len(m.Members), c.MinMembers)
+
+	statuses := make(map[string]int)
+	for _, n := range m.Members {
+		statuses[n.Status]++
+	}
+	names := make([]string, 0, len(statuses))
+	for status := range statuses {
+		names = append(names, status)
+	}
+	sort.Strings(names)
+	for _, status := range names {
+		fmt.Fprintf(w, "      %s: %d\n", status, statuses[status])
+	}
+	return healthy
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/common/log"
+)
+
+// domainEventsRetryInterval is the time to wait before reconnecting to a
+// domain events stream that failed.
+const domainEventsRetryInterval = 5 * time.Second
+
+// domainEvent is a cluster domain event as sent by the Akka Management
+// /cluster/domain-events stream.
+type domainEvent struct {
+	Type    string
+	Address string
+	Member  struct {
+		Status        string
+		Roles         []string
+		DataCenter    string
+		UniqueAddress struct {
+			Address string
+			LongUid int64
+		}
+	}
+}
+
+// domainEventView is the cluster view built from a domain events stream.
+// Only the members, their reachability and the leader are part of the
+// stream, so the view has no self node or oldest member.
+type domainEventView struct {
+	mutex       sync.Mutex
+	connected   bool
+	leader      string
+	members     map[string]ClusterNode
+	unreachable map[string]bool
+}
+
+func (v *domainEventView) reset() {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	v.connected = true
+	v.leader = ""
+	v.members = make(map[string]ClusterNode)
+	v.unreachable = make(map[string]bool)
+}
+
+func (v *domainEventView) disconnect() {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	v.connected = false
+}
+
+func (v *domainEventView) apply(event domainEvent) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	address := event.Member.UniqueAddress.Address
+	switch event.Type {
+	case "MemberJoined", "MemberWeaklyUp", "MemberUp", "MemberLeft", "MemberExited", "MemberDowned":
+		v.members[address] = ClusterNode{
+			Node:       address,
+			NodeUid:    strconv.FormatInt(event.Member.UniqueAddress.LongUid, 10),
+			Status:     event.Member.Status,
+			Roles:      event.Member.Roles,
+			DataCenter: event.Member.DataCenter,
+		}
+	case "MemberRemoved":
+		delete(v.members, address)
+		delete(v.unreachable, address)
+	case "UnreachableMember":
+		v.unreachable[address] = true
+	case "ReachableMember":
+		delete(v.unreachable, address)
+	case "LeaderChanged":
+		v.leader = event.Address
+	}
+}
+
+// domainEventSnapshot is a membership response served from a domainEventView,
+// which scrapes tell apart from the endpoint's responses by its type.
+type domainEventSnapshot struct {
+	*bytes.Reader
+}
+
+func (domainEventSnapshot) Close() error {
+	return nil
+}
+
+// snapshot returns the view as a membership response, or false if the
+// stream isn't connected.
+func (v *domainEventView) snapshot() ([]byte, bool) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	if !v.connected {
+		return nil, false
+	}
+	m := Cluster{Leader: v.leader}
+	for _, n := range v.members {
+		m.Members = append(m.Members, n)
+	}
+	for node := range v.unreachable {
+		m.Unreachable = append(m.Unreachable, ClusterNode{Node: node})
+	}
+	b, err := json.Marshal(m)
+	return b, err == nil
+}
+
+// FollowDomainEvents keeps a cluster view up to date from the domain events
+// stream at uri, and serves it instead of scraping while the stream is
+// connected. Scrapes fall back to the endpoint otherwise. It must be called
+// before the exporter is collected.
+func (e *Exporter) FollowDomainEvents(uri string, transport http.RoundTripper) {
+	view := &domainEventView{}
+	poll := e.fetch
+	e.fetch = func(ctx context.Context) (io.ReadCloser, error) {
+		if b, ok := view.snapshot(); ok {
+			return domainEventSnapshot{bytes.NewReader(b)}, nil
+		}
+		return poll(ctx)
+	}
+
+	client := &http.Client{Transport: transport}
+	go func() {
+		for {
+			err := streamDomainEvents(client, uri, view)
+			view.disconnect()
+			log.Warnf("Lost akka cluster domain events stream, scraping until reconnected: %v", err)
+			time.Sleep(domainEventsRetryInterval)
+		}
+	}()
+}
+
+// streamDomainEvents applies the events of the server-sent events stream at
+// uri to view until the stream ends.
+func streamDomainEvents(client *http.Client, uri string, view *domainEventView) error {
+	req, err := http.NewRequest("GET", uri, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if !(resp.StatusCode >= 200 && resp.StatusCode < 300) {
+		return statusError(resp.StatusCode)
+	}
+
+	// The stream starts with the current state as events.
+	view.reset()
+	log.Infoln("Following akka cluster domain events from", redactURI(uri))
+
+	var eventType string
+	var data []string
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			if len(data) > 0 {
+				var event domainEvent
+				if err := json.Unmarshal([]byte(strings.Join(data, "\n")), &event); err != nil {
+					return fmt.Errorf("can't parse domain event: %v", err)
+				}
+				if eventType != "" {
+					event.Type = eventType
+				}
+				view.apply(event)
+			}
+			eventType, data = "", nil
+		case strings.HasPrefix(line, "event:"):
+			eventType = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+		case strings.HasPrefix(line, "data:"):
+			data = append(data, strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return io.EOF
+}
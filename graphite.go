@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/log"
+)
+
+// graphiteReplacer replaces the characters Graphite uses as path separators
+// or can't handle in a path component.
+var graphiteReplacer = strings.NewReplacer(".", "_", " ", "_", "/", "_", ":", "_", "@", "_")
+
+// metricPath appends the label values, ordered by label name, to name as
+// dot separated path components.
+func metricPath(name string, labels []*dto.LabelPair) string {
+	sort.Sort(prometheus.LabelPairSorter(labels))
+	path := name
+	for _, l := range labels {
+		path += "." + graphiteReplacer.Replace(l.GetValue())
+	}
+	return path
+}
+
+// pushGraphite sends the metrics of the given collectors to the Graphite
+// plaintext listener at address right away and then every interval. It never
+// returns.
+func pushGraphite(address string, interval time.Duration, collectors ...prometheus.Collector) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for ; ; <-ticker.C {
+		var buf bytes.Buffer
+		now := time.Now().Unix()
+		for _, m := range gatherMetrics(collectors...) {
+			if err := writeGraphite(&buf, m, now); err != nil {
+				log.Errorf("Can't format metric for graphite: %v", err)
+			}
+		}
+
+		conn, err := net.DialTimeout("tcp", address, interval)
+		if err != nil {
+			log.Errorf("Can't connect to graphite: %v", err)
+			continue
+		}
+		conn.SetWriteDeadline(time.Now().Add(interval))
+		if _, err := buf.WriteTo(conn); err != nil {
+			log.Errorf("Can't push metrics to graphite: %v", err)
+		}
+		conn.Close()
+	}
+}
+
+// writeGraphite writes m in the Graphite plaintext format. The path is the
+// metric name with the namespace as first component, followed by the label
+// values ordered by label name, e.g. akka.current_members.Up. Histograms are
+// written as their sum and count.
+func writeGraphite(buf *bytes.Buffer, m prometheus.Metric, timestamp int64) error {
+	info, err := parseDesc(m.Desc())
+	if err != nil {
+		return err
+	}
+	var metric dto.Metric
+	if err := m.Write(&metric); err != nil {
+		return err
+	}
+
+	path := metricPath(strings.Replace(info.Name, "_", ".", 1), metric.GetLabel())
+
+	switch {
+	case metric.Gauge != nil:
+		fmt.Fprintf(buf, "%s %g %d\n", path, metric.Gauge.GetValue(), timestamp)
+	case metric.Counter != nil:
+		fmt.Fprintf(buf, "%s %g %d\n", path, metric.Counter.GetValue(), timestamp)
+	case metric.Histogram != nil:
+		fmt.Fprintf(buf, "%s.sum %g %d\n", path, metric.Histogram.GetSampleSum(), timestamp)
+		fmt.Fprintf(buf, "%s.count %d %d\n", path, metric.Histogram.GetSampleCount(), timestamp)
+	}
+	return nil
+}
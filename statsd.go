@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/log"
+)
+
+// statsdMaxPacketSize keeps StatsD packets below the usual network MTU.
+const statsdMaxPacketSize = 1400
+
+// pushStatsD sends the metrics of the given collectors as StatsD gauges to
+// address right away and then every interval. Metric names are the prefix
+// followed by the metric name without namespace and the label values, e.g.
+// akka.current_members.Up.
+// The address is resolved again on every send until that succeeds. It never
+// returns.
+func pushStatsD(address string, prefix string, interval time.Duration, collectors ...prometheus.Collector) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var conn net.Conn
+	for ; ; <-ticker.C {
+		if conn == nil {
+			var err error
+			if conn, err = net.Dial("udp", address); err != nil {
+				log.Errorf("Can't set up statsd client: %v", err)
+				continue
+			}
+		}
+
+		var packet bytes.Buffer
+		for _, m := range gatherMetrics(collectors...) {
+			lines, err := statsdLines(m, prefix)
+			if err != nil {
+				log.Errorf("Can't format metric for statsd: %v", err)
+				continue
+			}
+			for _, line := range lines {
+				if packet.Len() > 0 && packet.Len()+len(line) > statsdMaxPacketSize {
+					sendStatsD(conn, &packet)
+				}
+				packet.WriteString(line)
+			}
+		}
+		sendStatsD(conn, &packet)
+	}
+}
+
+func sendStatsD(conn net.Conn, packet *bytes.Buffer) {
+	if packet.Len() == 0 {
+		return
+	}
+	if _, err := packet.WriteTo(conn); err != nil {
+		log.Errorf("Can't send metrics to statsd: %v", err)
+	}
+	packet.Reset()
+}
+
+// statsdLines formats m as StatsD gauges. Histograms are sent as their sum
+// and count.
+func statsdLines(m prometheus.Metric, prefix string) ([]string, error) {
+	info, err := parseDesc(m.Desc())
+	if err != nil {
+		return nil, err
+	}
+	var metric dto.Metric
+	if err := m.Write(&metric); err != nil {
+		return nil, err
+	}
+
+	path := metricPath(prefix+strings.TrimPrefix(info.Name, namespace+"_"), metric.GetLabel())
+	switch {
+	case metric.Gauge != nil:
+		return []string{fmt.Sprintf("%s:%g|g\n", path, metric.Gauge.GetValue())}, nil
+	case metric.Counter != nil:
+		return []string{fmt.Sprintf("%s:%g|g\n", path, metric.Counter.GetValue())}, nil
+	case metric.Histogram != nil:
+		return []string{
+			fmt.Sprintf("%s.sum:%g|g\n", path, metric.Histogram.GetSampleSum()),
+			fmt.Sprintf("%s.count:%d|g\n", path, metric.Histogram.GetSampleCount()),
+		}, nil
+	}
+	return nil, nil
+}
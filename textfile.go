@@ -0,0 +1,54 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/log"
+)
+
+// writeTextfile writes the metrics of the given collectors to path right
+// away and then every interval, for the node_exporter textfile collector to
+// pick up. It never returns.
+func writeTextfile(path string, interval time.Duration, collectors ...prometheus.Collector) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := writeTextfileOnce(path, collectors...); err != nil {
+			log.Errorf("Can't write metrics to %s: %v", path, err)
+		}
+		<-ticker.C
+	}
+}
+
+// writeTextfileOnce writes the metrics to a temporary file next to path and
+// renames it, so readers never see a partially written file.
+func writeTextfileOnce(path string, collectors ...prometheus.Collector) error {
+	families, err := gatherFamilies(collectors...)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	for _, mf := range families {
+		if _, err := expfmt.MetricFamilyToText(tmp, mf); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}